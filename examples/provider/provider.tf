@@ -7,11 +7,15 @@ terraform {
 }
 
 provider "solarwinds-orion" {
-  # example configuration here
+  server    = "orion.example.com"
+  port      = 443
+  scheme    = "https"
+  base_path = "/orion/SolarWinds/InformationService/v3/Json"
 }
 
-resource "solarwinds_orion_ip" "auto" {
-    vlan_address = "10.12.72.0"
-    comment = "Reserved by s1slt000321"
-}
+resource "orion_ip" "auto" {
+  provider = solarwinds-orion
 
+  vlan_address = "10.12.72.0"
+  comment      = "Reserved by s1slt000321"
+}
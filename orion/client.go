@@ -0,0 +1,265 @@
+package orion
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client for the SolarWinds Information Service (SWIS) JSON API. It mirrors the
+// gosolar client, but owns its HTTP client so the transport can be configured.
+type swisClient struct {
+	URL      string
+	Username string
+	Password string
+
+	basicAuth      bool
+	readOnly       bool
+	userAgent      string
+	requestTag     string
+	requestTimeout time.Duration
+	http           *http.Client
+	failover       *failoverTransport
+}
+
+// Header carrying the request_tag provider setting
+const requestTagHeader = "X-Request-Tag"
+
+// Connection settings resolved from the provider configuration
+type swisClientConfig struct {
+	Endpoint string
+	// host:port of every server to fail over between, the endpoint host is ignored when set
+	Hosts    []string
+	Username string
+	Password string
+
+	// Either authMethodBasic or authMethodNTLM, the domain only applies to NTLM
+	AuthMethod string
+	Domain     string
+
+	TLSConfig *tls.Config
+	Proxy     func(*http.Request) (*url.URL, error)
+
+	MaxRetries   int
+	RetryWaitMin time.Duration
+	RetryWaitMax time.Duration
+
+	RequestTimeout time.Duration
+
+	MaxConcurrentRequests int
+	RequestsPerSecond     float64
+
+	// Refuse every call that could change state in Orion
+	ReadOnly bool
+
+	// Sent with every request so the traffic can be found in IIS and audit logs
+	UserAgent  string
+	RequestTag string
+}
+
+func newSwisClient(config swisClientConfig) *swisClient {
+	base := &http.Transport{
+		Proxy:               config.Proxy,
+		TLSClientConfig:     config.TLSConfig,
+		MaxIdleConnsPerHost: 4,
+	}
+
+	var transport http.RoundTripper = base
+	if config.AuthMethod == authMethodNTLM {
+		transport = newNTLMTransport(base, config.Domain, config.Username, config.Password)
+	}
+
+	var failover *failoverTransport
+	if len(config.Hosts) > 1 {
+		failover = &failoverTransport{base: transport, hosts: config.Hosts}
+		transport = failover
+	}
+
+	if config.MaxConcurrentRequests > 0 || config.RequestsPerSecond > 0 {
+		transport = newLimitTransport(transport, config.MaxConcurrentRequests, config.RequestsPerSecond)
+	}
+
+	if config.MaxRetries > 0 {
+		transport = &retryTransport{
+			base:         transport,
+			maxRetries:   config.MaxRetries,
+			retryWaitMin: config.RetryWaitMin,
+			retryWaitMax: config.RetryWaitMax,
+		}
+	}
+
+	return &swisClient{
+		URL:      config.Endpoint,
+		Username: config.Username,
+		Password: config.Password,
+
+		basicAuth:      config.AuthMethod != authMethodNTLM,
+		readOnly:       config.ReadOnly,
+		userAgent:      config.UserAgent,
+		requestTag:     config.RequestTag,
+		failover:       failover,
+		requestTimeout: config.RequestTimeout,
+		http: &http.Client{
+			Transport: transport,
+		},
+	}
+}
+
+// Error response returned by SWIS
+type swisError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *swisError) Error() string {
+	return fmt.Sprintf("swis failure message [status: %d]:\n%s", e.StatusCode, e.Message)
+}
+
+// Send a request to the given SWIS endpoint and return the response body.
+// Idempotent requests may be retried by the transport, the request timeout
+// covers all attempts.
+func (c *swisClient) do(ctx context.Context, method string, endpoint string, body interface{}, idempotent bool) ([]byte, error) {
+	if c.requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.requestTimeout)
+		defer cancel()
+	}
+
+	if idempotent {
+		ctx = withIdempotent(ctx)
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %v", err)
+		}
+		reqBody = &buf
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+endpoint, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a new request: %v", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	if c.requestTag != "" {
+		req.Header.Set(requestTagHeader, c.requestTag)
+	}
+	if c.basicAuth {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to submit request: %w", err)
+	}
+	defer res.Body.Close()
+
+	output, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("request failed - status code %d: %v", res.StatusCode, err)
+	}
+
+	if res.StatusCode >= 400 {
+		return nil, &swisError{StatusCode: res.StatusCode, Message: string(output)}
+	}
+
+	return output, nil
+}
+
+// Query runs a SWQL query and returns the raw "results" array
+func (c *swisClient) Query(ctx context.Context, query string, parameters interface{}) ([]byte, error) {
+	req := struct {
+		Query      string      `json:"query"`
+		Parameters interface{} `json:"parameters"`
+	}{
+		Query:      query,
+		Parameters: parameters,
+	}
+
+	result, err := c.do(ctx, http.MethodPost, "Query", &req, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query: %w", err)
+	}
+
+	sr := struct {
+		Result json.RawMessage `json:"results"`
+	}{}
+
+	if err := json.Unmarshal(result, &sr); err != nil {
+		return nil, err
+	}
+
+	return sr.Result, nil
+}
+
+// Read returns the properties of the entity with the given URI
+func (c *swisClient) Read(ctx context.Context, uri string) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, uri, nil, true)
+}
+
+// Create a new entity of the given type
+func (c *swisClient) Create(ctx context.Context, entity string, body interface{}) ([]byte, error) {
+	if c.readOnly {
+		return nil, &readOnlyError{Operation: "create", Target: entity}
+	}
+	return c.do(ctx, http.MethodPost, "Create/"+entity, body, false)
+}
+
+// Update the properties of the entity with the given URI
+func (c *swisClient) Update(ctx context.Context, uri string, body map[string]interface{}) ([]byte, error) {
+	if c.readOnly {
+		return nil, &readOnlyError{Operation: "update", Target: uri}
+	}
+	return c.do(ctx, http.MethodPost, uri, body, false)
+}
+
+// Delete the entity with the given URI
+func (c *swisClient) Delete(ctx context.Context, uri string) ([]byte, error) {
+	if c.readOnly {
+		return nil, &readOnlyError{Operation: "delete", Target: uri}
+	}
+	return c.do(ctx, http.MethodDelete, uri, nil, false)
+}
+
+// Invoke a verb on the given entity type
+func (c *swisClient) Invoke(ctx context.Context, entity string, verb string, body interface{}) ([]byte, error) {
+	if c.readOnly && !isReadVerb(verb) {
+		return nil, &readOnlyError{Operation: "invoke", Target: entity + "." + verb}
+	}
+	return c.do(ctx, http.MethodPost, "Invoke/"+entity+"/"+verb, body, false)
+}
+
+// Verbs that only look things up, anything else is assumed to change state
+var readVerbPrefixes = []string{"Get", "List", "Find", "Search", "Is", "Check", "Test", "Validate"}
+
+func isReadVerb(verb string) bool {
+	for _, prefix := range readVerbPrefixes {
+		if strings.HasPrefix(verb, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returned for any mutating call when the provider is configured as read only
+type readOnlyError struct {
+	Operation string
+	Target    string
+}
+
+func (e *readOnlyError) Error() string {
+	return fmt.Sprintf("refusing to %s %s: the provider is configured with read_only = true", e.Operation, e.Target)
+}
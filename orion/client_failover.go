@@ -0,0 +1,136 @@
+package orion
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+)
+
+type endpointKey struct{}
+
+// Pin a request to the endpoint with the given index, bypassing failover
+func withEndpoint(ctx context.Context, index int) context.Context {
+	return context.WithValue(ctx, endpointKey{}, index)
+}
+
+// Transport spreading requests over several SWIS servers sharing the same
+// scheme, port and base path. Requests go to the active server and move on
+// to the next one when it cannot be reached. The active server sticks until
+// it fails.
+type failoverTransport struct {
+	base  http.RoundTripper
+	hosts []string
+
+	mu     sync.Mutex
+	active int
+}
+
+func (t *failoverTransport) activeHost() (int, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active, t.hosts[t.active]
+}
+
+func (t *failoverTransport) setActive(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active != index {
+		log.Printf("[WARN] SWIS failing over from %s to %s", t.hosts[t.active], t.hosts[index])
+		t.active = index
+	}
+}
+
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if index, ok := req.Context().Value(endpointKey{}).(int); ok {
+		return t.send(req, index, false)
+	}
+
+	start, _ := t.activeHost()
+
+	var lastErr error
+	for i := 0; i < len(t.hosts); i++ {
+		index := (start + i) % len(t.hosts)
+
+		res, err := t.send(req, index, i > 0)
+		if err == nil {
+			t.setActive(index)
+			return res, nil
+		}
+
+		// Only give up on a server when it could not be reached at all
+		lastErr = err
+		if req.Context().Err() != nil || !isConnectionError(err) {
+			return nil, err
+		}
+		log.Printf("[WARN] SWIS server %s unreachable: %v", t.hosts[index], err)
+	}
+
+	return nil, lastErr
+}
+
+// Send the request to the endpoint with the given index, rewinding the body when it was already sent
+func (t *failoverTransport) send(req *http.Request, index int, rewind bool) (*http.Response, error) {
+	clone := req.Clone(req.Context())
+	clone.URL.Host = t.hosts[index]
+	clone.Host = ""
+
+	if rewind && req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, errors.New("cannot fail over request with a body that cannot be rewound")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+
+	res, err := t.base.RoundTrip(clone)
+	if err == nil {
+		log.Printf("[DEBUG] SWIS %s %s served by %s", req.Method, req.URL.Path, t.hosts[index])
+	}
+	return res, err
+}
+
+// Query every server once and make the first one answering the active one.
+// Returns the last error when none answers.
+func (c *swisClient) checkEndpoints(ctx context.Context) error {
+	if c.failover == nil {
+		return nil
+	}
+
+	healthy := -1
+	var lastErr error
+	for index, host := range c.failover.hosts {
+		_, err := c.Query(withoutRetries(withEndpoint(ctx, index)), "SELECT TOP 1 FullName FROM Metadata.Entity", nil)
+		if err != nil {
+			log.Printf("[WARN] SWIS server %s failed its health check: %v", host, err)
+			lastErr = err
+			continue
+		}
+		log.Printf("[INFO] SWIS server %s is healthy", host)
+		if healthy < 0 {
+			healthy = index
+		}
+	}
+
+	if healthy < 0 {
+		return lastErr
+	}
+
+	c.failover.setActive(healthy)
+	return nil
+}
+
+// Errors meaning the server could not be reached, so nothing was sent to it
+func isConnectionError(err error) bool {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	return errors.As(err, &dnsErr) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		(errors.As(err, &opErr) && opErr.Op == "dial")
+}
@@ -0,0 +1,115 @@
+package orion
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxConcurrentRequests = 4
+	defaultRequestsPerSecond     = 0
+)
+
+// Transport that caps the number of in-flight SWIS requests and spaces them
+// out to the configured rate. A single instance is shared by every resource
+// and data source using the provider's client.
+type limitTransport struct {
+	base http.RoundTripper
+
+	// Buffered channel used as a semaphore, nil when concurrency is unlimited
+	slots chan struct{}
+
+	// Minimum time between the start of two requests, zero when unlimited
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+func newLimitTransport(base http.RoundTripper, maxConcurrent int, requestsPerSecond float64) *limitTransport {
+	t := &limitTransport{base: base}
+	if maxConcurrent > 0 {
+		t.slots = make(chan struct{}, maxConcurrent)
+	}
+	if requestsPerSecond > 0 {
+		t.interval = time.Duration(float64(time.Second) / requestsPerSecond)
+	}
+	return t
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	if err := t.wait(ctx); err != nil {
+		t.release()
+		return nil, err
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.release()
+		return nil, err
+	}
+
+	// Keep the slot until the caller is done reading the response
+	res.Body = &releaseOnClose{ReadCloser: res.Body, release: t.release}
+	return res, nil
+}
+
+// Block until the rate limit allows another request to start
+func (t *limitTransport) wait(ctx context.Context) error {
+	if t.interval == 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	now := time.Now()
+	start := t.next
+	if start.Before(now) {
+		start = now
+	}
+	t.next = start.Add(t.interval)
+	t.mu.Unlock()
+
+	delay := time.Until(start)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *limitTransport) release() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(r.release)
+	return err
+}
@@ -0,0 +1,360 @@
+package orion
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+const (
+	authMethodBasic = "basic"
+	authMethodNTLM  = "ntlm"
+)
+
+// NTLMSSP negotiate flags, see MS-NLMP 2.2.2.5
+const (
+	ntlmNegotiateUnicode            = 0x00000001
+	ntlmNegotiateOEM                = 0x00000002
+	ntlmRequestTarget               = 0x00000004
+	ntlmNegotiateNTLM               = 0x00000200
+	ntlmNegotiateAlwaysSign         = 0x00008000
+	ntlmNegotiateExtendedSession    = 0x00080000
+	ntlmNegotiateVersion            = 0x02000000
+	ntlmNegotiate128                = 0x20000000
+	ntlmNegotiate56                 = 0x80000000
+	ntlmAvIDTimestamp               = 7
+	ntlmAvIDEOL                     = 0
+	ntlmChallengeMinimumLength      = 48
+	ntlmAuthenticateHeaderLength    = 64
+	ntlmFiletimeEpochOffsetSeconds  = 11644473600
+	ntlmHandshakeAttemptsPerRequest = 2
+)
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// Transport authenticating requests with NTLMv2. NTLM authenticates the TCP
+// connection rather than the request, so a request is first sent as is and
+// the handshake only runs when SWIS answers 401 on a fresh connection.
+//
+// Every connection lives in its own session, a clone of the base transport
+// allowed a single connection per host. A request holds its session until
+// the response body is closed, so nothing else can take the connection
+// between the legs of a handshake or use it while it is being authenticated.
+type ntlmTransport struct {
+	base     *http.Transport
+	domain   string
+	username string
+	password string
+
+	// Sessions not in use, and a semaphore capping how many exist
+	idle  chan *http.Transport
+	slots chan struct{}
+}
+
+func newNTLMTransport(base *http.Transport, domain string, username string, password string) *ntlmTransport {
+	// Accept DOMAIN\user when no domain was given separately
+	if domain == "" {
+		if i := strings.Index(username, `\`); i > 0 {
+			domain, username = username[:i], username[i+1:]
+		}
+	}
+
+	sessions := base.MaxIdleConnsPerHost
+	if sessions <= 0 {
+		sessions = http.DefaultMaxIdleConnsPerHost
+	}
+
+	return &ntlmTransport{
+		base:     base,
+		domain:   domain,
+		username: username,
+		password: password,
+		idle:     make(chan *http.Transport, sessions),
+		slots:    make(chan struct{}, sessions),
+	}
+}
+
+func (t *ntlmTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	session, err := t.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	release := func() { t.idle <- session }
+
+	res, err := t.roundTrip(session, req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	// Keep the session until the caller is done reading the response
+	res.Body = &releaseOnClose{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+// Take an idle session, or open a new one while under the cap
+func (t *ntlmTransport) acquire(ctx context.Context) (*http.Transport, error) {
+	select {
+	case session := <-t.idle:
+		return session, nil
+	default:
+	}
+
+	select {
+	case session := <-t.idle:
+		return session, nil
+	case t.slots <- struct{}{}:
+		session := t.base.Clone()
+		session.MaxConnsPerHost = 1
+		session.MaxIdleConnsPerHost = 1
+		return session, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *ntlmTransport) roundTrip(session *http.Transport, req *http.Request) (*http.Response, error) {
+	res, err := session.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized || !offersNTLM(res) {
+		return res, err
+	}
+	discardBody(res)
+
+	for attempt := 1; ; attempt++ {
+		res, err = t.handshake(session, req)
+		if err != nil || res.StatusCode != http.StatusUnauthorized || attempt >= ntlmHandshakeAttemptsPerRequest {
+			return res, err
+		}
+		discardBody(res)
+	}
+}
+
+// Run the negotiate and authenticate legs of the handshake on the session's
+// connection, the response to the authenticate leg is the response to the
+// request itself
+func (t *ntlmTransport) handshake(session *http.Transport, req *http.Request) (*http.Response, error) {
+	negotiateReq, err := withNTLMAuthorization(req, ntlmNegotiateMessage())
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := session.RoundTrip(negotiateReq)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		return res, nil
+	}
+
+	challenge, err := ntlmChallengeFromResponse(res)
+	discardBody(res)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticate, err := ntlmAuthenticateMessage(challenge, t.domain, t.username, t.password)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticateReq, err := withNTLMAuthorization(req, authenticate)
+	if err != nil {
+		return nil, err
+	}
+
+	return session.RoundTrip(authenticateReq)
+}
+
+// Clone the request with a fresh body and the given NTLM message as authorization
+func withNTLMAuthorization(req *http.Request, message []byte) (*http.Request, error) {
+	clone := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, errors.New("cannot authenticate request with a body that cannot be rewound")
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		clone.Body = body
+	}
+	clone.Header.Set("Authorization", "NTLM "+base64.StdEncoding.EncodeToString(message))
+	return clone, nil
+}
+
+func offersNTLM(res *http.Response) bool {
+	for _, header := range res.Header.Values("WWW-Authenticate") {
+		if strings.EqualFold(strings.TrimSpace(header), "NTLM") || strings.HasPrefix(strings.ToUpper(header), "NTLM ") {
+			return true
+		}
+	}
+	return false
+}
+
+func discardBody(res *http.Response) {
+	_, _ = io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+}
+
+func ntlmNegotiateMessage() []byte {
+	message := make([]byte, 32)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 1)
+	binary.LittleEndian.PutUint32(message[12:], ntlmNegotiateUnicode|ntlmNegotiateOEM|ntlmRequestTarget|
+		ntlmNegotiateNTLM|ntlmNegotiateAlwaysSign|ntlmNegotiateExtendedSession|ntlmNegotiate128|ntlmNegotiate56)
+	// Domain and workstation fields stay empty
+	return message
+}
+
+type ntlmChallenge struct {
+	flags      uint32
+	challenge  []byte
+	targetInfo []byte
+}
+
+func ntlmChallengeFromResponse(res *http.Response) (*ntlmChallenge, error) {
+	for _, header := range res.Header.Values("WWW-Authenticate") {
+		if len(header) > 5 && strings.EqualFold(header[:5], "NTLM ") {
+			message, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[5:]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid NTLM challenge: %v", err)
+			}
+			return parseNTLMChallenge(message)
+		}
+	}
+	return nil, errors.New("server did not answer the NTLM negotiation with a challenge")
+}
+
+func parseNTLMChallenge(message []byte) (*ntlmChallenge, error) {
+	if len(message) < ntlmChallengeMinimumLength || !bytes.Equal(message[:8], ntlmSignature) || binary.LittleEndian.Uint32(message[8:]) != 2 {
+		return nil, errors.New("invalid NTLM challenge message")
+	}
+
+	challenge := &ntlmChallenge{
+		flags:     binary.LittleEndian.Uint32(message[20:]),
+		challenge: message[24:32],
+	}
+
+	infoLength := int(binary.LittleEndian.Uint16(message[40:]))
+	infoOffset := int(binary.LittleEndian.Uint32(message[44:]))
+	if infoOffset+infoLength > len(message) {
+		return nil, errors.New("invalid NTLM challenge target info")
+	}
+	challenge.targetInfo = message[infoOffset : infoOffset+infoLength]
+
+	return challenge, nil
+}
+
+// Timestamp from the challenge target info, if the server sent one
+func (c *ntlmChallenge) timestamp() ([]byte, bool) {
+	info := c.targetInfo
+	for len(info) >= 4 {
+		id := binary.LittleEndian.Uint16(info)
+		length := int(binary.LittleEndian.Uint16(info[2:]))
+		if id == ntlmAvIDEOL || len(info) < 4+length {
+			break
+		}
+		if id == ntlmAvIDTimestamp && length == 8 {
+			return info[4:12], true
+		}
+		info = info[4+length:]
+	}
+	return nil, false
+}
+
+// Build the NTLMv2 authenticate message answering the given challenge, see MS-NLMP 3.3.2
+func ntlmAuthenticateMessage(challenge *ntlmChallenge, domain string, username string, password string) ([]byte, error) {
+	ntHash := md4.New()
+	ntHash.Write(utf16le(password))
+
+	v2Hash := hmac.New(md5.New, ntHash.Sum(nil))
+	v2Hash.Write(utf16le(strings.ToUpper(username) + domain))
+	responseKey := v2Hash.Sum(nil)
+
+	clientChallenge := make([]byte, 8)
+	if _, err := rand.Read(clientChallenge); err != nil {
+		return nil, err
+	}
+
+	timestamp, serverTimestamp := challenge.timestamp()
+	if !serverTimestamp {
+		timestamp = make([]byte, 8)
+		filetime := uint64(time.Now().UnixNano()/100) + ntlmFiletimeEpochOffsetSeconds*10000000
+		binary.LittleEndian.PutUint64(timestamp, filetime)
+	}
+
+	var blob bytes.Buffer
+	blob.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	blob.Write(timestamp)
+	blob.Write(clientChallenge)
+	blob.Write([]byte{0, 0, 0, 0})
+	blob.Write(challenge.targetInfo)
+	blob.Write([]byte{0, 0, 0, 0})
+
+	proof := hmac.New(md5.New, responseKey)
+	proof.Write(challenge.challenge)
+	proof.Write(blob.Bytes())
+	ntResponse := append(proof.Sum(nil), blob.Bytes()...)
+
+	// The LMv2 response must be zeroed when the server supplied a timestamp
+	lmResponse := make([]byte, 24)
+	if !serverTimestamp {
+		lm := hmac.New(md5.New, responseKey)
+		lm.Write(challenge.challenge)
+		lm.Write(clientChallenge)
+		lmResponse = append(lm.Sum(nil), clientChallenge...)
+	}
+
+	fields := [][]byte{
+		lmResponse,
+		ntResponse,
+		utf16le(domain),
+		utf16le(username),
+		nil, // workstation
+		nil, // encrypted random session key
+	}
+
+	message := make([]byte, ntlmAuthenticateHeaderLength)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 3)
+
+	offset := ntlmAuthenticateHeaderLength
+	for i, field := range fields {
+		header := message[12+8*i:]
+		binary.LittleEndian.PutUint16(header, uint16(len(field)))
+		binary.LittleEndian.PutUint16(header[2:], uint16(len(field)))
+		binary.LittleEndian.PutUint32(header[4:], uint32(offset))
+		offset += len(field)
+	}
+
+	flags := challenge.flags&^ntlmNegotiateVersion | ntlmNegotiateUnicode
+	binary.LittleEndian.PutUint32(message[60:], flags)
+
+	for _, field := range fields {
+		message = append(message, field...)
+	}
+
+	return message, nil
+}
+
+func utf16le(s string) []byte {
+	encoded := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return b
+}
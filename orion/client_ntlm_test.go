@@ -0,0 +1,232 @@
+package orion
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/md4"
+)
+
+// State of one TCP connection to the stub server
+type ntlmStubConn struct {
+	challenge     []byte
+	authenticated bool
+}
+
+type ntlmStubConnKey struct{}
+
+// SWIS stub accepting only NTLMv2 authenticated connections
+type ntlmStub struct {
+	t        *testing.T
+	domain   string
+	username string
+	password string
+
+	mu          sync.Mutex
+	connections int
+	handshakes  int
+	rejected    int
+}
+
+func (s *ntlmStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn := r.Context().Value(ntlmStubConnKey{}).(*ntlmStubConn)
+
+	if conn.authenticated {
+		w.Write([]byte(`{"results":[]}`))
+		return
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "NTLM ") {
+		w.Header().Set("WWW-Authenticate", "NTLM")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	message, err := base64.StdEncoding.DecodeString(header[5:])
+	if err != nil || len(message) < 12 || !bytes.Equal(message[:8], ntlmSignature) {
+		s.t.Errorf("invalid NTLM message %q", header)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch binary.LittleEndian.Uint32(message[8:]) {
+	case 1:
+		conn.challenge = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+		w.Header().Set("WWW-Authenticate", "NTLM "+base64.StdEncoding.EncodeToString(ntlmStubChallenge(conn.challenge)))
+		w.WriteHeader(http.StatusUnauthorized)
+
+	case 3:
+		// The authenticate leg only counts on the connection that was challenged
+		if conn.challenge == nil || !s.verify(message, conn.challenge) {
+			s.mu.Lock()
+			s.rejected++
+			s.mu.Unlock()
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		conn.authenticated = true
+
+		s.mu.Lock()
+		s.handshakes++
+		s.mu.Unlock()
+		w.Write([]byte(`{"results":[]}`))
+
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// Check the NTLMv2 response of an authenticate message against the stub's credentials
+func (s *ntlmStub) verify(message []byte, challenge []byte) bool {
+	field := func(i int) []byte {
+		header := message[12+8*i:]
+		length := int(binary.LittleEndian.Uint16(header))
+		offset := int(binary.LittleEndian.Uint32(header[4:]))
+		return message[offset : offset+length]
+	}
+
+	ntResponse := field(1)
+	if len(ntResponse) <= 16 || string(field(2)) != string(utf16le(s.domain)) || string(field(3)) != string(utf16le(s.username)) {
+		return false
+	}
+
+	ntHash := md4.New()
+	ntHash.Write(utf16le(s.password))
+	v2Hash := hmac.New(md5.New, ntHash.Sum(nil))
+	v2Hash.Write(utf16le(strings.ToUpper(s.username) + s.domain))
+
+	proof := hmac.New(md5.New, v2Hash.Sum(nil))
+	proof.Write(challenge)
+	proof.Write(ntResponse[16:])
+	return hmac.Equal(proof.Sum(nil), ntResponse[:16])
+}
+
+// Challenge message carrying a timestamp in its target info
+func ntlmStubChallenge(challenge []byte) []byte {
+	info := []byte{ntlmAvIDTimestamp, 0, 8, 0, 1, 2, 3, 4, 5, 6, 7, 8, ntlmAvIDEOL, 0, 0, 0}
+
+	message := make([]byte, ntlmChallengeMinimumLength)
+	copy(message, ntlmSignature)
+	binary.LittleEndian.PutUint32(message[8:], 2)
+	binary.LittleEndian.PutUint32(message[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateExtendedSession)
+	copy(message[24:], challenge)
+	binary.LittleEndian.PutUint16(message[40:], uint16(len(info)))
+	binary.LittleEndian.PutUint16(message[42:], uint16(len(info)))
+	binary.LittleEndian.PutUint32(message[44:], uint32(len(message)))
+	return append(message, info...)
+}
+
+func (s *ntlmStub) counts() (connections int, handshakes int, rejected int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections, s.handshakes, s.rejected
+}
+
+func newNTLMStubServer(t *testing.T, stub *ntlmStub) *httptest.Server {
+	server := httptest.NewUnstartedServer(stub)
+	server.Config.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		stub.mu.Lock()
+		stub.connections++
+		stub.mu.Unlock()
+		return context.WithValue(ctx, ntlmStubConnKey{}, &ntlmStubConn{})
+	}
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestNTLMHandshake(t *testing.T) {
+	stub := &ntlmStub{t: t, domain: "CORP", username: "svc-orion", password: "secret"}
+	server := newNTLMStubServer(t, stub)
+
+	client := newSwisClient(swisClientConfig{
+		Endpoint:   server.URL + "/",
+		Username:   `CORP\svc-orion`,
+		Password:   "secret",
+		AuthMethod: authMethodNTLM,
+	})
+
+	// The first query runs the handshake, the second reuses the authenticated connection
+	for i := 0; i < 2; i++ {
+		if _, err := client.Query(context.Background(), "SELECT 1 FROM Orion.Nodes", nil); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+
+	connections, handshakes, _ := stub.counts()
+	if handshakes != 1 || connections != 1 {
+		t.Errorf("expected one handshake on one connection, got %d handshakes on %d connections", handshakes, connections)
+	}
+}
+
+func TestNTLMHandshakeWrongPassword(t *testing.T) {
+	stub := &ntlmStub{t: t, domain: "CORP", username: "svc-orion", password: "secret"}
+	server := newNTLMStubServer(t, stub)
+
+	client := newSwisClient(swisClientConfig{
+		Endpoint:   server.URL + "/",
+		Username:   "svc-orion",
+		Password:   "wrong",
+		Domain:     "CORP",
+		AuthMethod: authMethodNTLM,
+	})
+
+	_, err := client.Query(context.Background(), "SELECT 1 FROM Orion.Nodes", nil)
+	var swisErr *swisError
+	if !errors.As(err, &swisErr) || swisErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected a 401 swis error, got %v", err)
+	}
+	if _, _, rejected := stub.counts(); rejected != ntlmHandshakeAttemptsPerRequest {
+		t.Errorf("expected %d rejected handshakes, got %d", ntlmHandshakeAttemptsPerRequest, rejected)
+	}
+}
+
+func TestNTLMConcurrentRequests(t *testing.T) {
+	stub := &ntlmStub{t: t, domain: "CORP", username: "svc-orion", password: "secret"}
+	server := newNTLMStubServer(t, stub)
+
+	client := newSwisClient(swisClientConfig{
+		Endpoint:   server.URL + "/",
+		Username:   "svc-orion",
+		Password:   "secret",
+		Domain:     "CORP",
+		AuthMethod: authMethodNTLM,
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Query(context.Background(), "SELECT 1 FROM Orion.Nodes", nil); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	connections, handshakes, rejected := stub.counts()
+	if rejected != 0 {
+		t.Errorf("%d authenticate legs did not reach the challenged connection", rejected)
+	}
+	if handshakes > connections {
+		t.Errorf("%d handshakes on %d connections, authenticated connections were not reused", handshakes, connections)
+	}
+}
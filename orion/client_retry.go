@@ -0,0 +1,175 @@
+package orion
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultMaxRetries   = 4
+	defaultRetryWaitMin = 1 * time.Second
+	defaultRetryWaitMax = 30 * time.Second
+)
+
+type idempotentKey struct{}
+
+type noRetryKey struct{}
+
+// Mark a request as safe to repeat. SWIS queries are sent as POST, so the HTTP
+// method alone cannot tell reads and writes apart.
+func withIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+// Send a request once, for checks that should fail fast
+func withoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+func isIdempotent(req *http.Request) bool {
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return true
+	}
+	idempotent, _ := req.Context().Value(idempotentKey{}).(bool)
+	return idempotent
+}
+
+// Transport that retries transient SWIS failures with exponential backoff.
+// Reads are retried on any transient failure, writes only when the server
+// cannot have acted on them.
+type retryTransport struct {
+	base         http.RoundTripper
+	maxRetries   int
+	retryWaitMin time.Duration
+	retryWaitMax time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if noRetry, _ := req.Context().Value(noRetryKey{}).(bool); noRetry {
+		return t.base.RoundTrip(req)
+	}
+
+	idempotent := isIdempotent(req)
+
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 && req.Body != nil {
+			if req.GetBody == nil {
+				return nil, errors.New("cannot retry request with a body that cannot be rewound")
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+
+		res, err := t.base.RoundTrip(attemptReq)
+
+		retry := false
+		if err != nil {
+			retry = req.Context().Err() == nil && isTransientError(err, idempotent)
+		} else {
+			retry = isTransientStatus(res.StatusCode, idempotent)
+		}
+
+		if !retry || attempt >= t.maxRetries {
+			if attempt > 0 {
+				log.Printf("[DEBUG] SWIS %s %s finished after %d attempts", req.Method, req.URL.Path, attempt+1)
+			}
+			return res, err
+		}
+
+		wait := t.backoff(attempt, res)
+		if err != nil {
+			log.Printf("[WARN] SWIS %s %s attempt %d/%d failed: %v, retrying in %s", req.Method, req.URL.Path, attempt+1, t.maxRetries+1, err, wait)
+		} else {
+			log.Printf("[WARN] SWIS %s %s attempt %d/%d returned status %d, retrying in %s", req.Method, req.URL.Path, attempt+1, t.maxRetries+1, res.StatusCode, wait)
+			_, _ = io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Exponential backoff bounded by retryWaitMax, honouring Retry-After when the server sends it
+func (t *retryTransport) backoff(attempt int, res *http.Response) time.Duration {
+	if res != nil {
+		if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+			wait := time.Duration(seconds) * time.Second
+			if wait > t.retryWaitMax {
+				wait = t.retryWaitMax
+			}
+			return wait
+		}
+	}
+
+	wait := t.retryWaitMin
+	for i := 0; i < attempt && wait < t.retryWaitMax; i++ {
+		wait *= 2
+	}
+	if wait > t.retryWaitMax {
+		wait = t.retryWaitMax
+	}
+	return wait
+}
+
+// 429 and 503 mean the request was turned away, 502 and 504 may come after SWIS already acted on it
+func isTransientStatus(status int, idempotent bool) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+func isTransientError(err error, idempotent bool) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return false
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+
+	// Nothing was sent if the connection could not be established, so writes are safe to repeat
+	var opErr *net.OpError
+	if errors.Is(err, syscall.ECONNREFUSED) || (errors.As(err, &opErr) && opErr.Op == "dial") {
+		return true
+	}
+
+	if !idempotent {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,329 @@
+package orion
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// Keeps the first ten hosts of every subnet for gateways, like the old fixed window
+const defaultExcludeFirst = 10
+
+// Addresses an allocation must not hand out
+type ipExclusions struct {
+	First  int64
+	Last   int64
+	Ranges []ipRange
+}
+
+// Inclusive range given by addresses or host ordinals
+type ipRange struct {
+	Start string
+	End   string
+}
+
+// Element of an exclude_ranges list
+type excludeRangeModel struct {
+	Start types.String `tfsdk:"start"`
+	End   types.String `tfsdk:"end"`
+}
+
+// Resolve the exclusions resources fall back to from the provider configuration and the environment
+func resolveProviderExclusions(ctx context.Context, config orionConfig) (ipExclusions, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	exclusions := ipExclusions{
+		First: int64FromConfigOrEnv(config.ExcludeFirst, "SOLARWINDS_ORION_EXCLUDE_FIRST", defaultExcludeFirst, path.Root("exclude_first"), &diags),
+		Last:  int64FromConfigOrEnv(config.ExcludeLast, "SOLARWINDS_ORION_EXCLUDE_LAST", 0, path.Root("exclude_last"), &diags),
+	}
+
+	if exclusions.First < 0 {
+		diags.AddAttributeError(
+			path.Root("exclude_first"),
+			"Invalid number of excluded addresses given",
+			fmt.Sprintf("exclude_first must not be negative, got %d", exclusions.First),
+		)
+	}
+
+	if exclusions.Last < 0 {
+		diags.AddAttributeError(
+			path.Root("exclude_last"),
+			"Invalid number of excluded addresses given",
+			fmt.Sprintf("exclude_last must not be negative, got %d", exclusions.Last),
+		)
+	}
+
+	if !config.ExcludeRanges.IsNull() {
+		ranges, rangeDiags := excludeRangesFromList(ctx, config.ExcludeRanges)
+		diags.Append(rangeDiags...)
+		exclusions.Ranges = ranges
+		return exclusions, diags
+	}
+
+	if v := os.Getenv("SOLARWINDS_ORION_EXCLUDE_RANGES"); v != "" {
+		ranges, err := parseExcludeRanges(v)
+		if err != nil {
+			diags.AddAttributeError(
+				path.Root("exclude_ranges"),
+				"Invalid value in SOLARWINDS_ORION_EXCLUDE_RANGES",
+				err.Error(),
+			)
+		}
+		exclusions.Ranges = ranges
+	}
+
+	return exclusions, diags
+}
+
+// Exclusions for one resource, attributes it leaves unset fall back to the provider's
+func resolveExclusions(ctx context.Context, plan resourceIPReservationModel, defaults ipExclusions) (ipExclusions, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	exclusions := defaults
+	if !plan.ExcludeFirst.IsNull() {
+		exclusions.First = plan.ExcludeFirst.ValueInt64()
+	}
+	if !plan.ExcludeLast.IsNull() {
+		exclusions.Last = plan.ExcludeLast.ValueInt64()
+	}
+	if !plan.ExcludeRanges.IsNull() {
+		exclusions.Ranges, diags = excludeRangesFromList(ctx, plan.ExcludeRanges)
+	}
+
+	return exclusions, diags
+}
+
+func excludeRangesFromList(ctx context.Context, list types.List) ([]ipRange, diag.Diagnostics) {
+	var elements []excludeRangeModel
+	diags := list.ElementsAs(ctx, &elements, false)
+
+	ranges := make([]ipRange, len(elements))
+	for i, element := range elements {
+		ranges[i] = ipRange{Start: element.Start.ValueString(), End: element.End.ValueString()}
+	}
+	return ranges, diags
+}
+
+// Parse comma separated start-end pairs
+func parseExcludeRanges(v string) ([]ipRange, error) {
+	var ranges []ipRange
+	for _, pair := range strings.Split(v, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(pair, "-")
+		if !ok {
+			return nil, fmt.Errorf("'%s' is not a start-end pair", pair)
+		}
+		ranges = append(ranges, ipRange{Start: strings.TrimSpace(start), End: strings.TrimSpace(end)})
+	}
+	return ranges, nil
+}
+
+// Host ordinals in a subnet that the exclusions leave to allocate from
+type ordinalWindow struct {
+	network  *net.IPNet
+	first    *big.Int
+	last     *big.Int
+	excluded [][2]*big.Int
+}
+
+// Window of given Subnet, bounds come from the subnet's own prefix length
+func (e ipExclusions) window(subnet *Subnet) (*ordinalWindow, error) {
+	_, network, err := net.ParseCIDR(subnet.Address + "/" + strconv.Itoa(subnet.CIDR))
+	if err != nil {
+		return nil, err
+	}
+
+	ones, bits := network.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+
+	// Network and broadcast addresses are not hosts, except in point-to-point
+	// subnets. IPv6 has no broadcast but keeps the first address for routers.
+	first := big.NewInt(0)
+	last := new(big.Int).Sub(size, big.NewInt(1))
+	if bits == 32 && ones < 31 {
+		first.SetInt64(1)
+		last.Sub(last, big.NewInt(1))
+	}
+	if bits == 128 && ones < 127 {
+		first.SetInt64(1)
+	}
+
+	first.Add(first, big.NewInt(e.First))
+	last.Sub(last, big.NewInt(e.Last))
+	if first.Cmp(last) > 0 {
+		rangeErr := errors.New("Excluding the first " + strconv.FormatInt(e.First, 10) + " and last " + strconv.FormatInt(e.Last, 10) + " addresses leaves no IPs in subnet " + network.String() + "!")
+		return nil, rangeErr
+	}
+
+	w := &ordinalWindow{network: network, first: first, last: last}
+
+	// Ranges may be shared by many subnets, only the part inside this one matters
+	base := new(big.Int).SetBytes(network.IP)
+	top := new(big.Int).Add(base, new(big.Int).Sub(size, big.NewInt(1)))
+	for _, r := range e.Ranges {
+		start, err := ipBound(network, r.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := ipBound(network, r.End)
+		if err != nil {
+			return nil, err
+		}
+		if start == nil || end == nil {
+			continue
+		}
+		if start.Cmp(end) > 0 {
+			start, end = end, start
+		}
+		if end.Cmp(base) < 0 || start.Cmp(top) > 0 {
+			continue
+		}
+		if start.Cmp(base) < 0 {
+			start = base
+		}
+		if end.Cmp(top) > 0 {
+			end = top
+		}
+		w.excluded = append(w.excluded, [2]*big.Int{new(big.Int).Sub(start, base), new(big.Int).Sub(end, base)})
+	}
+
+	return w, nil
+}
+
+// SWQL condition limiting IPOrdinal to the window
+func (w *ordinalWindow) filter() string {
+	filter := "IPOrdinal BETWEEN " + w.first.String() + " AND " + w.last.String()
+	for _, r := range w.excluded {
+		filter += " AND NOT (IPOrdinal BETWEEN " + r[0].String() + " AND " + r[1].String() + ")"
+	}
+	return filter
+}
+
+// Ordinal picked at random between the window's bounds, it may be excluded
+func (w *ordinalWindow) random() *big.Int {
+	span := new(big.Int).Sub(w.last, w.first)
+	ordinal := new(big.Int).Rand(rand.New(rand.NewSource(time.Now().UnixNano())), span.Add(span, big.NewInt(1)))
+	return ordinal.Add(ordinal, w.first)
+}
+
+// Walk from start by step, one way or the other, to the first ordinal inside
+// the window that is neither excluded nor taken. Nil when there is none.
+func (w *ordinalWindow) next(start *big.Int, step int64, taken map[string]bool) *big.Int {
+	ordinal := new(big.Int).Set(start)
+	for ordinal.Cmp(w.first) >= 0 && ordinal.Cmp(w.last) <= 0 {
+		if r, ok := w.excludedRange(ordinal); ok {
+			if step > 0 {
+				ordinal.Add(r[1], big.NewInt(1))
+			} else {
+				ordinal.Sub(r[0], big.NewInt(1))
+			}
+			continue
+		}
+		if !taken[ordinal.String()] {
+			return ordinal
+		}
+		ordinal.Add(ordinal, big.NewInt(step))
+	}
+	return nil
+}
+
+func (w *ordinalWindow) excludedRange(ordinal *big.Int) ([2]*big.Int, bool) {
+	for _, r := range w.excluded {
+		if ordinal.Cmp(r[0]) >= 0 && ordinal.Cmp(r[1]) <= 0 {
+			return r, true
+		}
+	}
+	return [2]*big.Int{}, false
+}
+
+// Ordinal of an address in the window's subnet, false when it lies outside
+func (w *ordinalWindow) ordinal(address string) (*big.Int, bool) {
+	ip := net.ParseIP(address)
+	if ip == nil || !w.network.Contains(ip) {
+		return nil, false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ordinal := new(big.Int).SetBytes(ip)
+	return ordinal.Sub(ordinal, new(big.Int).SetBytes(w.network.IP)), true
+}
+
+// Address at an ordinal of the window's subnet
+func (w *ordinalWindow) address(ordinal *big.Int) string {
+	address := new(big.Int).Add(new(big.Int).SetBytes(w.network.IP), ordinal)
+	ip := make(net.IP, len(w.network.IP))
+	address.FillBytes(ip)
+	return ip.String()
+}
+
+// Absolute value of an excluded range bound given as an address or as a host
+// number within the subnet. Nil for addresses of the other IP family.
+func ipBound(network *net.IPNet, value string) (*big.Int, error) {
+	if ordinal, ok := new(big.Int).SetString(value, 10); ok {
+		if ordinal.Sign() < 0 {
+			ordinalErr := errors.New("Excluded host number " + value + " must not be negative!")
+			return nil, ordinalErr
+		}
+		return ordinal.Add(ordinal, new(big.Int).SetBytes(network.IP)), nil
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		ipErr := errors.New("Excluded range bound '" + value + "' is neither an IP address nor a host number!")
+		return nil, ipErr
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if len(ip) != len(network.IP) {
+		return nil, nil
+	}
+	return new(big.Int).SetBytes(ip), nil
+}
+
+// Whether an address falls in one of the ranges, which must be given by addresses
+func addressInRanges(address string, ranges []ipRange) bool {
+	ip := addressValue(address)
+	if ip == nil {
+		return false
+	}
+
+	for _, r := range ranges {
+		start, end := addressValue(r.Start), addressValue(r.End)
+		if start == nil || end == nil || len(start) != len(ip) || len(end) != len(ip) {
+			continue
+		}
+		if bytes.Compare(start, end) > 0 {
+			start, end = end, start
+		}
+		if bytes.Compare(ip, start) >= 0 && bytes.Compare(ip, end) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Address in its shortest form, so addresses of one family compare bytewise
+func addressValue(address string) net.IP {
+	ip := net.ParseIP(address)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
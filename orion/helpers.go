@@ -1,28 +1,53 @@
 package orion
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"github.com/mrxinu/gosolar"
 	"log"
+	"math/big"
+	"math/rand"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 )
 
-// Check if subnet given by address has DHCP Scope
-func checkIfSubnetDHCP(client *gosolar.Client, subnetAddress string) (bool, error) {
+// How many free addresses an allocation tries before giving up
+const maxAllocationAttempts = 5
+
+// How deep the IPAM tree of groups and supernets is walked when building a path
+const maxGroupDepth = 32
+
+// How long a claim waits before re-reading the address. A writer that checked
+// the address was free just before our write lands its own write within this
+// window, so the re-read sees it. Every create pays it once, the subnet lock
+// is not held while waiting.
+var claimSettleDelay = 1 * time.Second
+
+// Names of the IPAM statuses, as the IPAM.SubnetManagement verbs take them
+var ipStatusNames = map[int]string{
+	1: "Used",
+	2: "Available",
+	4: "Reserved",
+	8: "Transient",
+}
+
+// Columns of IPAM.Subnet every subnet lookup selects
+const subnetColumns = "Vlan,Address,SubnetId,ParentId,FriendlyName,Uri,CIDR,GroupTypeText"
+
+// Check if subnet given by it's ID has DHCP Scope
+func checkIfSubnetDHCP(ctx context.Context, client *swisClient, subnetId int) (bool, error) {
 	var subnetInfo []Subnet
 
-	query := "SELECT Vlan,SubnetId,Uri,GroupTypeText,CIDR FROM IPAM.Subnet WHERE  Address='" + subnetAddress + "'AND GroupTypeText='DHCP Scope'"
-	res, err := client.Query(query, nil)
+	query := "SELECT Vlan,SubnetId,Uri,GroupTypeText,CIDR FROM IPAM.Subnet WHERE SubnetId='" + strconv.Itoa(subnetId) + "' AND GroupTypeText='DHCP Scope'"
+	res, err := client.Query(ctx, query, nil)
 	if err != nil {
-		log.Fatal(err)
 		return false, err
 	}
 
 	jsonErr := json.Unmarshal(res, &subnetInfo)
 	if jsonErr != nil {
-		log.Fatal(jsonErr)
 		return false, jsonErr
 	}
 
@@ -35,88 +60,269 @@ func checkIfSubnetDHCP(client *gosolar.Client, subnetAddress string) (bool, erro
 	}
 }
 
-// Get Subnet ID by it's address
-func getSubnetId(client *gosolar.Client, subnetAddress string) (int, error) {
-	var subnetInfo []Subnet
+// Get the address pools DHCP servers hand out from in given Subnet
+func getDhcpPoolRanges(ctx context.Context, client *swisClient, subnetId int) ([]ipRange, error) {
+	var pools []struct {
+		StartAddress string `json:"startaddress"`
+		EndAddress   string `json:"endaddress"`
+	}
 
-	query := "SELECT Vlan,Address,SubnetId,Uri,CIDR,GroupTypeText FROM IPAM.Subnet WHERE Address='" + subnetAddress + "'"
-	res, err := client.Query(query, nil)
+	query := "SELECT StartAddress,EndAddress FROM IPAM.DhcpRange WHERE SubnetId='" + strconv.Itoa(subnetId) + "'"
+	res, err := client.Query(ctx, query, nil)
 	if err != nil {
-		log.Fatal(err)
-		return 0, err
+		return nil, err
 	}
 
-	jsonErr := json.Unmarshal(res, &subnetInfo)
+	jsonErr := json.Unmarshal(res, &pools)
 	if jsonErr != nil {
-		log.Fatal(jsonErr)
-		return 0, jsonErr
+		return nil, jsonErr
 	}
 
-	if len(subnetInfo) == 0 {
-		subnetErr := errors.New("Could not find provided subnet!")
-		return 0, subnetErr
+	ranges := make([]ipRange, len(pools))
+	for i, pool := range pools {
+		ranges[i] = ipRange{Start: pool.StartAddress, End: pool.EndAddress}
 	}
-
-	log.Print("Subnet address is " + subnetInfo[0].Address + " and it's scope: " + subnetInfo[0].GroupTypeText)
-	return subnetInfo[0].SubnetId, nil
+	return ranges, nil
 }
 
-// Get Subnet Address by it's ID
-func getSubnetAddress(client *gosolar.Client, subnetId int) (string, error) {
+// Get all Subnets matching the SWQL condition
+func querySubnets(ctx context.Context, client *swisClient, condition string) ([]Subnet, error) {
 	var subnetInfo []Subnet
-	query := "SELECT Vlan,Address,SubnetId,Uri,CIDR,GroupTypeText FROM IPAM.Subnet WHERE SubnetId='" + strconv.Itoa(subnetId) + "'"
-	res, err := client.Query(query, nil)
+
+	query := "SELECT " + subnetColumns + " FROM IPAM.Subnet WHERE " + condition
+	res, err := client.Query(ctx, query, nil)
 	if err != nil {
-		log.Fatal(err)
-		return "", err
+		return nil, err
 	}
 
 	jsonErr := json.Unmarshal(res, &subnetInfo)
 	if jsonErr != nil {
-		log.Fatal(jsonErr)
-		return "", jsonErr
+		return nil, jsonErr
 	}
 
-	if len(subnetInfo) == 0 {
-		subnetErr := errors.New("Could not find provided subnet!")
-		return "", subnetErr
+	return subnetInfo, nil
+}
+
+// Pick the only Subnet a lookup found. The same range may exist in several
+// IPAM groups, so several matches are an error naming every candidate.
+func singleSubnet(ctx context.Context, client *swisClient, subnets []Subnet, lookup string) (*Subnet, error) {
+	if len(subnets) == 0 {
+		subnetErr := errors.New("Could not find subnet " + lookup + "!")
+		return nil, subnetErr
 	}
 
-	log.Print("Subnet address is " + subnetInfo[0].Address + " and it's scope: " + subnetInfo[0].GroupTypeText)
-	return subnetInfo[0].Address, nil
+	if len(subnets) > 1 {
+		candidates := make([]string, len(subnets))
+		for i, subnet := range subnets {
+			candidates[i] = describeSubnet(ctx, client, subnet)
+		}
+		subnetErr := errors.New("Subnet " + lookup + " is ambiguous, it matches " + strconv.Itoa(len(subnets)) + " subnets: " + strings.Join(candidates, "; ") + ". Select one with subnet_id or subnet_group!")
+		return nil, subnetErr
+	}
+
+	return &subnets[0], nil
 }
 
-// Get VLAN name by subnet address
-func getVlanName(client *gosolar.Client, subnetAddress string) (string, error) {
-	var subnetInfo []Subnet
+// Describe a Subnet well enough to tell it apart from others with the same range
+func describeSubnet(ctx context.Context, client *swisClient, subnet Subnet) string {
+	description := "subnet_id " + strconv.Itoa(subnet.SubnetId) + " (" + subnet.Address + "/" + strconv.Itoa(subnet.CIDR)
+	if path, err := getSubnetPath(ctx, client, subnet); err == nil {
+		description += " in " + path
+	}
+	return description + ")"
+}
 
-	query := "SELECT Vlan,Address,SubnetId,Uri,CIDR,GroupTypeText FROM IPAM.Subnet WHERE  Address='" + subnetAddress + "'"
-	res, err := client.Query(query, nil)
+// Get Subnet by it's address
+func getSubnet(ctx context.Context, client *swisClient, subnetAddress string) (*Subnet, error) {
+	subnets, err := querySubnets(ctx, client, "Address='"+normalizeAddress(subnetAddress)+"'")
 	if err != nil {
-		log.Fatal(err)
-		return "", err
+		return nil, err
 	}
 
-	jsonErr := json.Unmarshal(res, &subnetInfo)
-	if jsonErr != nil {
-		log.Fatal(jsonErr)
-		return "", jsonErr
+	return singleSubnet(ctx, client, subnets, subnetAddress)
+}
+
+// Get Subnet by it's ID
+func getSubnetById(ctx context.Context, client *swisClient, subnetId int) (*Subnet, error) {
+	subnets, err := querySubnets(ctx, client, "SubnetId='"+strconv.Itoa(subnetId)+"'")
+	if err != nil {
+		return nil, err
 	}
 
-	if len(subnetInfo) == 0 {
-		subnetErr := errors.New("Could not find provided subnet!")
-		return "", subnetErr
+	return singleSubnet(ctx, client, subnets, strconv.Itoa(subnetId))
+}
+
+// Get Subnet by it's address and prefix length
+func getSubnetByCIDR(ctx context.Context, client *swisClient, subnetAddress string, cidr int) (*Subnet, error) {
+	subnets, err := querySubnets(ctx, client, "Address='"+normalizeAddress(subnetAddress)+"' AND CIDR="+strconv.Itoa(cidr))
+	if err != nil {
+		return nil, err
 	}
 
-	log.Print("Vlan name is " + subnetInfo[0].VlanName + " and it's scope: " + subnetInfo[0].GroupTypeText)
-	return subnetInfo[0].VlanName, nil
+	return singleSubnet(ctx, client, subnets, subnetAddress+"/"+strconv.Itoa(cidr))
 }
 
-// Get first free IP Entity in given Subnet by it's ID
-func getFreeIpEntity(client *gosolar.Client, subnetId int) (*IPEntity, error) {
+// Get Subnet by the path of group, supernet and subnet names leading to it,
+// such as "Datacenter/Servers/Web". Leading groups may be left out.
+func getSubnetByPath(ctx context.Context, client *swisClient, subnetPath string) (*Subnet, error) {
+	subnetPath = strings.Trim(subnetPath, "/")
+
+	// Names may contain slashes themselves, so any tail of the path may be the subnet name
+	var names []string
+	for i := 0; i < len(subnetPath); i++ {
+		if i == 0 || subnetPath[i-1] == '/' {
+			names = append(names, "'"+strings.ReplaceAll(subnetPath[i:], "'", "''")+"'")
+		}
+	}
+
+	subnets, err := querySubnets(ctx, client, "FriendlyName IN ("+strings.Join(names, ",")+")")
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []Subnet
+	for _, subnet := range subnets {
+		path, err := getSubnetPath(ctx, client, subnet)
+		if err != nil {
+			return nil, err
+		}
+		if path == subnetPath || strings.HasSuffix(path, "/"+subnetPath) {
+			matches = append(matches, subnet)
+		}
+	}
+
+	return singleSubnet(ctx, client, matches, "'"+subnetPath+"'")
+}
+
+// Get the path of group, supernet and subnet names from the top of the IPAM tree down to given Subnet
+func getSubnetPath(ctx context.Context, client *swisClient, subnet Subnet) (string, error) {
+	names := []string{subnet.FriendlyName}
+
+	parentId := subnet.ParentId
+	for depth := 0; parentId != 0 && depth < maxGroupDepth; depth++ {
+		var groups []struct {
+			ParentId     int    `json:"parentid"`
+			FriendlyName string `json:"friendlyname"`
+		}
+
+		query := "SELECT ParentId,FriendlyName FROM IPAM.GroupNode WHERE GroupId='" + strconv.Itoa(parentId) + "'"
+		res, err := client.Query(ctx, query, nil)
+		if err != nil {
+			return "", err
+		}
+
+		jsonErr := json.Unmarshal(res, &groups)
+		if jsonErr != nil {
+			return "", jsonErr
+		}
+
+		if len(groups) == 0 || groups[0].ParentId == parentId {
+			break
+		}
+		names = append([]string{groups[0].FriendlyName}, names...)
+		parentId = groups[0].ParentId
+	}
+
+	return strings.Join(names, "/"), nil
+}
+
+// How a resource identifies its IPAM subnet, exactly one field is set
+type subnetSelector struct {
+	Address string
+	ID      int64
+	CIDR    string
+	Path    string
+}
+
+func (s subnetSelector) String() string {
+	switch {
+	case s.ID != 0:
+		return "subnet_id " + strconv.FormatInt(s.ID, 10)
+	case s.CIDR != "":
+		return "subnet_cidr " + s.CIDR
+	case s.Path != "":
+		return "subnet_group " + s.Path
+	}
+	return "vlan_address " + s.Address
+}
+
+// Get Subnet the selector points at
+func getSubnetBySelector(ctx context.Context, client *swisClient, selector subnetSelector) (*Subnet, error) {
+	switch {
+	case selector.ID != 0:
+		return getSubnetById(ctx, client, int(selector.ID))
+	case selector.CIDR != "":
+		subnetAddress, subnetNet, err := net.ParseCIDR(selector.CIDR)
+		if err != nil || !subnetAddress.Equal(subnetNet.IP) {
+			cidrErr := errors.New("'" + selector.CIDR + "' is not a valid subnet, expected a network address and prefix length such as 10.1.2.0/24!")
+			return nil, cidrErr
+		}
+		cidr, _ := subnetNet.Mask.Size()
+		return getSubnetByCIDR(ctx, client, subnetNet.IP.String(), cidr)
+	case selector.Path != "":
+		return getSubnetByPath(ctx, client, selector.Path)
+	}
+	return getSubnet(ctx, client, selector.Address)
+}
+
+// How a free IP Entity is picked
+type ipAllocation struct {
+	Strategy   string
+	HostNumber int64
+	Exclusions ipExclusions
+}
+
+// Get a free IP Entity in given Subnet according to the allocation, skipping the given addresses
+func getFreeIpEntity(ctx context.Context, client *swisClient, subnet *Subnet, allocation ipAllocation, skip []string) (*IPEntity, error) {
+	strategy := allocation.Strategy
+	if strategy == allocateHostnum {
+		return getHostnumIpEntity(ctx, client, subnet, allocation.HostNumber)
+	}
+
+	window, err := allocation.Exclusions.window(subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	if isIPv6Subnet(subnet) {
+		return getSparseFreeIpEntity(ctx, client, subnet, strategy, window, skip)
+	}
+
+	condition := window.filter()
+	if len(skip) != 0 {
+		condition += " AND IPAddress NOT IN ('" + strings.Join(skip, "','") + "')"
+	}
+
+	var ipEntity *IPEntity
+	switch strategy {
+	case allocateLast:
+		ipEntity, err = queryFreeIpEntity(ctx, client, subnet, condition, "IPOrdinal DESC")
+	case allocateRandom:
+		// First free address from a random point of the window on, wrapping around to its start
+		start := window.random().String()
+		ipEntity, err = queryFreeIpEntity(ctx, client, subnet, condition+" AND IPOrdinal >= "+start, "IPOrdinal")
+		if err == nil && ipEntity == nil {
+			ipEntity, err = queryFreeIpEntity(ctx, client, subnet, condition+" AND IPOrdinal < "+start, "IPOrdinal")
+		}
+	default:
+		ipEntity, err = queryFreeIpEntity(ctx, client, subnet, condition, "IPOrdinal")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ipEntity == nil {
+		ipNullErr := errors.New("There are no free IPs in this subnet!")
+		return nil, ipNullErr
+	}
+	return ipEntity, nil
+}
+
+// Get the first free IP Entity in given Subnet matching the SWQL condition in
+// the given order, nil when there is none
+func queryFreeIpEntity(ctx context.Context, client *swisClient, subnet *Subnet, condition string, order string) (*IPEntity, error) {
 	var ipEntity []IPEntity
-	query := "SELECT TOP 1 IpNodeId,IPAddress,Comments,Status,Uri FROM IPAM.IPNode WHERE SubnetId='" + strconv.Itoa(subnetId) + "' and status=2 AND IPOrdinal BETWEEN 11 AND 254"
-	res, err := client.Query(query, nil)
+	query := "SELECT TOP 1 IpNodeId,SubnetId,IPAddress,Comments,Status,Uri FROM IPAM.IPNode WHERE SubnetId='" + strconv.Itoa(subnet.SubnetId) + "' and status=2 AND " + condition + " ORDER BY " + order
+	res, err := client.Query(ctx, query, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -125,8 +331,7 @@ func getFreeIpEntity(client *gosolar.Client, subnetId int) (*IPEntity, error) {
 		return nil, jsonErr
 	}
 	if len(ipEntity) == 0 {
-		ipNullErr := errors.New("There are no free IPs in this subnet!")
-		return nil, ipNullErr
+		return nil, nil
 	}
 	if ipEntity[0].Status != 2 {
 		ipStatusErr := errors.New("Provided IP should have status 2 (free), but unexpectedly found " + strconv.Itoa(ipEntity[0].Status))
@@ -135,8 +340,106 @@ func getFreeIpEntity(client *gosolar.Client, subnetId int) (*IPEntity, error) {
 	return &ipEntity[0], nil
 }
 
+// Get a free IP Entity in a Subnet IPAM only keeps the used addresses of, such
+// as an IPv6 subnet. Addresses IPAM does not know are free and come back
+// without a URI, they still have to be created.
+func getSparseFreeIpEntity(ctx context.Context, client *swisClient, subnet *Subnet, strategy string, window *ordinalWindow, skip []string) (*IPEntity, error) {
+	ipEntities, err := getIpEntitiesInSubnet(ctx, client, subnet.SubnetId)
+	if err != nil {
+		return nil, err
+	}
+
+	taken := map[string]bool{}
+	free := map[string]IPEntity{}
+	for _, ipEntity := range ipEntities {
+		ordinal, ok := window.ordinal(ipEntity.IPAddress)
+		if !ok {
+			continue
+		}
+		if ipEntity.Status == 2 {
+			free[ordinal.String()] = ipEntity
+		} else {
+			taken[ordinal.String()] = true
+		}
+	}
+	for _, address := range skip {
+		if ordinal, ok := window.ordinal(address); ok {
+			taken[ordinal.String()] = true
+		}
+	}
+
+	var ordinal *big.Int
+	switch strategy {
+	case allocateLast:
+		ordinal = window.next(window.last, -1, taken)
+	case allocateRandom:
+		ordinal = window.next(window.random(), 1, taken)
+		if ordinal == nil {
+			ordinal = window.next(window.first, 1, taken)
+		}
+	default:
+		ordinal = window.next(window.first, 1, taken)
+	}
+
+	if ordinal == nil {
+		ipNullErr := errors.New("There are no free IPs in this subnet!")
+		return nil, ipNullErr
+	}
+
+	if ipEntity, ok := free[ordinal.String()]; ok {
+		return &ipEntity, nil
+	}
+	return &IPEntity{SubnetId: subnet.SubnetId, IPAddress: window.address(ordinal), Status: 2}, nil
+}
+
+// Get the IP Entity at the given host number in given Subnet, it must be free
+func getHostnumIpEntity(ctx context.Context, client *swisClient, subnet *Subnet, hostnum int64) (*IPEntity, error) {
+	ip_address, err := cidrHost(subnet.Address, subnet.CIDR, hostnum)
+	if err != nil {
+		return nil, err
+	}
+
+	ipEntity, err := getClaimableIpEntity(ctx, client, subnet, ip_address)
+	if err != nil {
+		return nil, err
+	}
+	if ipEntity.Status != 2 {
+		ipStatusErr := errors.New("Host number " + strconv.FormatInt(hostnum, 10) + " (" + ip_address + ") should have status 2 (free), but found " + strconv.Itoa(ipEntity.Status))
+		return nil, ipStatusErr
+	}
+	return ipEntity, nil
+}
+
+// Address of the given host number in a subnet, negative numbers count back
+// from the end of the subnet like Terraform's cidrhost
+func cidrHost(subnetAddress string, mask int, hostnum int64) (string, error) {
+	_, network, err := net.ParseCIDR(subnetAddress + "/" + strconv.Itoa(mask))
+	if err != nil {
+		return "", err
+	}
+
+	ones, bits := network.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+
+	host := big.NewInt(hostnum)
+	if hostnum < 0 {
+		host.Add(host, size)
+	}
+	if host.Sign() < 0 || host.Cmp(size) >= 0 {
+		hostnumErr := errors.New("Host number " + strconv.FormatInt(hostnum, 10) + " does not fit in subnet " + network.String() + "!")
+		return "", hostnumErr
+	}
+
+	address := new(big.Int).SetBytes(network.IP)
+	address.Add(address, host)
+
+	ip := make(net.IP, len(network.IP))
+	address.FillBytes(ip)
+	return ip.String(), nil
+}
+
 // Update IP Entity
-func updateIpEntity(client *gosolar.Client, ipEntity IPEntity, status int, comment string) error {
+func updateIpEntity(ctx context.Context, client *swisClient, ipEntity IPEntity, status int, comment string) error {
 	log.Print("I am going to book IP address: " + ipEntity.IPAddress + " with comment: " + comment + " and status " + strconv.Itoa(status))
 	if status == 2 {
 		comment = ""
@@ -146,7 +449,7 @@ func updateIpEntity(client *gosolar.Client, ipEntity IPEntity, status int, comme
 		"Comments": comment,
 	}
 	log.Print(request)
-	_, err := client.Update(ipEntity.Uri, request)
+	_, err := client.Update(ctx, ipEntity.Uri, request)
 
 	if err != nil {
 		return err
@@ -157,24 +460,248 @@ func updateIpEntity(client *gosolar.Client, ipEntity IPEntity, status int, comme
 	}
 }
 
-// Get IP Entity by it's address
-func getIpEntityByAddress(client *gosolar.Client, ipEntityAddress string) (*IPEntity, error) {
+// Write status and comment to a free IP Entity, creating it when IPAM does not
+// know the address yet. Returns false when someone else holds the address.
+// Callers hold the subnet lock, so allocations in this provider never book the
+// same address.
+func bookIpEntity(ctx context.Context, client *swisClient, ipEntity IPEntity, status int, comment string) (bool, error) {
+	current, err := lookupIpEntityInSubnet(ctx, client, ipEntity.SubnetId, ipEntity.IPAddress)
+	if err != nil {
+		return false, err
+	}
+
+	switch {
+	case current == nil:
+		err = createIpEntity(ctx, client, ipEntity, status, comment)
+	case current.Status != 2:
+		log.Printf("[WARN] %s was claimed by someone else before it could be booked", ipEntity.IPAddress)
+		return false, nil
+	default:
+		err = updateIpEntity(ctx, client, *current, status, comment)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Re-read a booked IP Entity once other writers had time to land, and check
+// the write is still ours. Other Terraform runs or IPAM users may claim the
+// same address between our query and our write, IPAM has no compare-and-swap
+// to prevent it. Runs without the subnet lock, so creates in one subnet wait
+// out the settle delay side by side rather than one after the other.
+func verifyIpEntity(ctx context.Context, client *swisClient, ipEntity IPEntity, status int, comment string) (bool, error) {
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(claimSettleDelay):
+	}
+
+	claimed, err := getIpEntityInSubnet(ctx, client, ipEntity.SubnetId, ipEntity.IPAddress)
+	if err != nil {
+		return false, err
+	}
+	if claimed.Status != status || (status != 2 && claimed.Comments != comment) {
+		log.Printf("[WARN] %s was overwritten by someone else, now has status %d and comment '%s'", ipEntity.IPAddress, claimed.Status, claimed.Comments)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// Book a free IP Entity and verify the booking is ours. Returns false when
+// someone else holds the address.
+func claimIpEntity(ctx context.Context, client *swisClient, locks *keyedMutex, ipEntity IPEntity, status int, comment string) (bool, error) {
+	unlock := locks.lock(subnetLockKey(ipEntity.SubnetId))
+	booked, err := bookIpEntity(ctx, client, ipEntity, status, comment)
+	unlock()
+	if err != nil || !booked {
+		return false, err
+	}
+
+	return verifyIpEntity(ctx, client, ipEntity, status, comment)
+}
+
+// Book a free IP Entity in given Subnet according to the allocation, moving on
+// to the next free one whenever another writer wins the race for an address.
+// A fixed host number has nowhere to move on to.
+func allocateIpEntity(ctx context.Context, client *swisClient, locks *keyedMutex, subnet *Subnet, allocation ipAllocation, status int, comment string) (*IPEntity, error) {
+	var lost []string
+	for attempt := 1; attempt <= maxAllocationAttempts; attempt++ {
+		// Parallel creates in one subnet would otherwise pick the same free address
+		unlock := locks.lock(subnetLockKey(subnet.SubnetId))
+		ipEntity, err := getFreeIpEntity(ctx, client, subnet, allocation, lost)
+		booked := false
+		if err == nil {
+			booked, err = bookIpEntity(ctx, client, *ipEntity, status, comment)
+		}
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		claimed := false
+		if booked {
+			claimed, err = verifyIpEntity(ctx, client, *ipEntity, status, comment)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if claimed {
+			return ipEntity, nil
+		}
+
+		if allocation.Strategy == allocateHostnum {
+			return nil, errors.New("IP address " + ipEntity.IPAddress + " was claimed by someone else while it was being booked!")
+		}
+
+		lost = append(lost, ipEntity.IPAddress)
+		log.Printf("[INFO] Retrying allocation in subnet %d after losing %s (attempt %d of %d)", subnet.SubnetId, ipEntity.IPAddress, attempt, maxAllocationAttempts)
+
+		// Back off a random while so the winner moves on before we pick the next address
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(rand.Int63n(int64(claimSettleDelay)))):
+		}
+	}
+
+	return nil, errors.New("Could not book a free IP after " + strconv.Itoa(maxAllocationAttempts) + " attempts, the subnet is too busy: lost " + strings.Join(lost, ", ") + "!")
+}
+
+// Get all IP Entities with the given address, one per subnet it appears in
+func getIpEntitiesByAddress(ctx context.Context, client *swisClient, ipEntityAddress string) ([]IPEntity, error) {
+	var ipEntity []IPEntity
+	query := "SELECT IpNodeId,SubnetId,IPAddress,Comments,Status,Uri FROM IPAM.IPNode WHERE IPAddress='" + normalizeAddress(ipEntityAddress) + "'"
+	res, err := client.Query(ctx, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	jsonErr := json.Unmarshal(res, &ipEntity)
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	if len(ipEntity) == 0 {
+		ipNullErr := errors.New("Could not find IP address " + ipEntityAddress + " in IPAM!")
+		return nil, ipNullErr
+	}
+	return ipEntity, nil
+}
+
+// Get IP Entity by it's address within the given Subnet
+func getIpEntityInSubnet(ctx context.Context, client *swisClient, subnetId int, ipEntityAddress string) (*IPEntity, error) {
+	ipEntity, err := lookupIpEntityInSubnet(ctx, client, subnetId, ipEntityAddress)
+	if err != nil {
+		return nil, err
+	}
+	if ipEntity == nil {
+		ipNullErr := errors.New("Could not find IP address " + ipEntityAddress + " in subnet " + strconv.Itoa(subnetId) + "!")
+		return nil, ipNullErr
+	}
+	return ipEntity, nil
+}
+
+// Look up IP Entity by it's address within the given Subnet, nil when IPAM has no such address
+func lookupIpEntityInSubnet(ctx context.Context, client *swisClient, subnetId int, ipEntityAddress string) (*IPEntity, error) {
 	var ipEntity []IPEntity
-	query := "SELECT IpNodeId,SubnetId,IPAddress,Comments,Status,Uri FROM IPAM.IPNode WHERE IPAddress='" + ipEntityAddress + "'"
-	res, err := client.Query(query, nil)
+	query := "SELECT IpNodeId,SubnetId,IPAddress,Comments,Status,Uri FROM IPAM.IPNode WHERE SubnetId='" + strconv.Itoa(subnetId) + "' AND IPAddress='" + normalizeAddress(ipEntityAddress) + "'"
+	res, err := client.Query(ctx, query, nil)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 	jsonErr := json.Unmarshal(res, &ipEntity)
 	if jsonErr != nil {
-		log.Fatal(jsonErr)
 		return nil, jsonErr
 	}
-	log.Print(ipEntity[0])
+	if len(ipEntity) == 0 {
+		return nil, nil
+	}
 	return &ipEntity[0], nil
 }
 
+// Get all IP Entities IPAM keeps for given Subnet
+func getIpEntitiesInSubnet(ctx context.Context, client *swisClient, subnetId int) ([]IPEntity, error) {
+	var ipEntity []IPEntity
+	query := "SELECT IpNodeId,SubnetId,IPAddress,Comments,Status,Uri FROM IPAM.IPNode WHERE SubnetId='" + strconv.Itoa(subnetId) + "'"
+	res, err := client.Query(ctx, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	jsonErr := json.Unmarshal(res, &ipEntity)
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	return ipEntity, nil
+}
+
+// Get the IP Entity for an address that is about to be claimed. IPAM does not
+// pre-populate IPv6 subnets, so a missing IPv6 address is free and still has
+// to be created.
+func getClaimableIpEntity(ctx context.Context, client *swisClient, subnet *Subnet, ipEntityAddress string) (*IPEntity, error) {
+	ipEntity, err := lookupIpEntityInSubnet(ctx, client, subnet.SubnetId, ipEntityAddress)
+	if err != nil {
+		return nil, err
+	}
+	if ipEntity != nil {
+		return ipEntity, nil
+	}
+	if !isIPv6Subnet(subnet) {
+		ipNullErr := errors.New("Could not find IP address " + ipEntityAddress + " in subnet " + strconv.Itoa(subnet.SubnetId) + "!")
+		return nil, ipNullErr
+	}
+	return &IPEntity{SubnetId: subnet.SubnetId, IPAddress: normalizeAddress(ipEntityAddress), Status: 2}, nil
+}
+
+// Create IP Entity for an address IPAM does not know yet. IPAM adds addresses
+// through the ChangeIpStatus verb, which takes no comment, so the comment is
+// written to the new node afterwards.
+func createIpEntity(ctx context.Context, client *swisClient, ipEntity IPEntity, status int, comment string) error {
+	log.Print("I am going to create IP address: " + ipEntity.IPAddress + " with comment: " + comment + " and status " + strconv.Itoa(status))
+	statusName, ok := ipStatusNames[status]
+	if !ok {
+		statusErr := errors.New("IP status " + strconv.Itoa(status) + " has no name IPAM knows!")
+		return statusErr
+	}
+
+	_, err := client.Invoke(ctx, "IPAM.SubnetManagement", "ChangeIpStatus", []interface{}{ipEntity.IPAddress, statusName})
+	if err != nil {
+		return err
+	}
+
+	created, err := getIpEntityInSubnet(ctx, client, ipEntity.SubnetId, ipEntity.IPAddress)
+	if err != nil {
+		return err
+	}
+	log.Print(ipEntity.IPAddress + " has been successfully created!")
+
+	return updateIpEntity(ctx, client, *created, status, comment)
+}
+
+// Whether given Subnet is an IPv6 subnet
+func isIPv6Subnet(subnet *Subnet) bool {
+	ip := net.ParseIP(subnet.Address)
+	return ip != nil && ip.To4() == nil
+}
+
+// Canonical text form of an address, as IPAM stores it. Anything that is not
+// an address is returned as is.
+func normalizeAddress(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	return ip.String()
+}
+
+// Whether two strings hold the same address, whatever way they are written
+func sameAddress(a string, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	return ipA.Equal(ipB)
+}
+
 // Valides if address is in proper IPv4 format
 func validateAddresses(ip_address string) error {
 	log.Print("#### VALIDATING IP ADDRESS ####")
@@ -0,0 +1,353 @@
+package orion
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	stubTopPattern     = regexp.MustCompile(`TOP (\d+)`)
+	stubBetweenPattern = regexp.MustCompile(`IPOrdinal BETWEEN (\d+) AND (\d+)`)
+	stubFromPattern    = regexp.MustCompile(`IPOrdinal >= (\d+)`)
+	stubBelowPattern   = regexp.MustCompile(`IPOrdinal < (\d+)`)
+	stubNotInPattern   = regexp.MustCompile(`IPAddress NOT IN \(([^)]*)\)`)
+	stubAddressPattern = regexp.MustCompile(`IPAddress='([^']+)'`)
+	stubSubnetPattern  = regexp.MustCompile(`SubnetId='(\d+)'`)
+)
+
+// IPAM stub serving the IPNode queries, updates and status changes
+// allocations make, for the 10.0.0.0/24 subnet with ID 1 and the sparse
+// 2001:db8::/64 subnet with ID 2. Node IDs are indexes into nodes, in subnet
+// 1 they are the ordinals too.
+type ipamStub struct {
+	mu    sync.Mutex
+	nodes []*IPEntity
+
+	// Addresses another writer takes right after our write lands
+	steal  map[string]string
+	booked map[string][]string
+}
+
+func newIpamStub(t *testing.T) (*ipamStub, *swisClient) {
+	stub := &ipamStub{steal: map[string]string{}, booked: map[string][]string{}}
+	for ordinal := 0; ordinal < 256; ordinal++ {
+		status := 2
+		if ordinal == 0 || ordinal == 255 {
+			status = 1
+		}
+		stub.nodes = append(stub.nodes, &IPEntity{
+			IpNodeId:  ordinal,
+			SubnetId:  1,
+			IPAddress: "10.0.0." + strconv.Itoa(ordinal),
+			Status:    status,
+			Uri:       "IPAM.IPNode/" + strconv.Itoa(ordinal),
+		})
+	}
+
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	return stub, newSwisClient(swisClientConfig{Endpoint: server.URL + "/"})
+}
+
+func (s *ipamStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path == "/Invoke/IPAM.SubnetManagement/ChangeIpStatus" {
+		var args []string
+		if err := json.NewDecoder(r.Body).Decode(&args); err != nil || len(args) != 2 {
+			http.Error(w, "expected address and status", http.StatusBadRequest)
+			return
+		}
+		status := 0
+		for code, name := range ipStatusNames {
+			if name == args[1] {
+				status = code
+			}
+		}
+		s.nodes = append(s.nodes, &IPEntity{
+			IpNodeId:  len(s.nodes),
+			SubnetId:  2,
+			IPAddress: args[0],
+			Status:    status,
+			Uri:       "IPAM.IPNode/" + strconv.Itoa(len(s.nodes)),
+		})
+		w.Write([]byte("null"))
+		return
+	}
+
+	if r.URL.Path == "/Query" {
+		var req struct {
+			Query string `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": s.query(req.Query)})
+		return
+	}
+
+	var req struct {
+		Status   int
+		Comments string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ordinal, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/IPAM.IPNode/"))
+	if err != nil || ordinal < 0 || ordinal >= len(s.nodes) {
+		http.Error(w, "no such node", http.StatusNotFound)
+		return
+	}
+
+	node := s.nodes[ordinal]
+	node.Status, node.Comments = req.Status, req.Comments
+	s.booked[node.IPAddress] = append(s.booked[node.IPAddress], req.Comments)
+	if thief, ok := s.steal[node.IPAddress]; ok {
+		delete(s.steal, node.IPAddress)
+		node.Status, node.Comments = 1, thief
+	}
+	w.Write([]byte("null"))
+}
+
+func (s *ipamStub) query(query string) []IPEntity {
+	results := []IPEntity{}
+
+	subnet, _ := strconv.Atoi(stubSubnetPattern.FindStringSubmatch(query)[1])
+
+	if !strings.Contains(query, "status=2") {
+		address := stubAddressPattern.FindStringSubmatch(query)
+		for _, node := range s.nodes {
+			if node.SubnetId == subnet && (address == nil || node.IPAddress == address[1]) {
+				results = append(results, *node)
+			}
+		}
+		return results
+	}
+
+	top, _ := strconv.Atoi(stubTopPattern.FindStringSubmatch(query)[1])
+	between := stubBetweenPattern.FindStringSubmatch(query)
+	first, _ := strconv.Atoi(between[1])
+	last, _ := strconv.Atoi(between[2])
+	if from := stubFromPattern.FindStringSubmatch(query); from != nil {
+		if start, _ := strconv.Atoi(from[1]); start > first {
+			first = start
+		}
+	}
+	if below := stubBelowPattern.FindStringSubmatch(query); below != nil {
+		if end, _ := strconv.Atoi(below[1]); end-1 < last {
+			last = end - 1
+		}
+	}
+	skip := ""
+	if notIn := stubNotInPattern.FindStringSubmatch(query); notIn != nil {
+		skip = notIn[1]
+	}
+
+	for _, node := range s.nodes {
+		if node.SubnetId == subnet && node.Status == 2 && node.IpNodeId >= first && node.IpNodeId <= last && !strings.Contains(skip, "'"+node.IPAddress+"'") {
+			results = append(results, *node)
+		}
+	}
+	if strings.Contains(query, "DESC") {
+		sort.Slice(results, func(i, j int) bool { return results[i].IpNodeId > results[j].IpNodeId })
+	}
+	if len(results) > top {
+		results = results[:top]
+	}
+	return results
+}
+
+func (s *ipamStub) node(address string) IPEntity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, node := range s.nodes {
+		if node.IPAddress == address {
+			return *node
+		}
+	}
+	return IPEntity{}
+}
+
+func (s *ipamStub) bookings(address string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.booked[address]
+}
+
+func withSettleDelay(t *testing.T, delay time.Duration) {
+	previous := claimSettleDelay
+	claimSettleDelay = delay
+	t.Cleanup(func() { claimSettleDelay = previous })
+}
+
+func TestAllocateIpEntityParallel(t *testing.T) {
+	withSettleDelay(t, 20*time.Millisecond)
+	stub, client := newIpamStub(t)
+	stub.steal["10.0.0.1"] = "someone else"
+
+	locks := &keyedMutex{locks: map[string]*sync.Mutex{}}
+	subnet := &Subnet{SubnetId: 1, Address: "10.0.0.0", CIDR: 24}
+	allocation := ipAllocation{Strategy: allocateFirst}
+
+	const creates = 16
+	addresses := make([]string, creates)
+	errs := make([]error, creates)
+
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ipEntity, err := allocateIpEntity(context.Background(), client, locks, subnet, allocation, 1, fmt.Sprintf("server%d", i))
+			if err == nil {
+				addresses[i] = ipEntity.IPAddress
+			}
+			errs[i] = err
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]int{}
+	for i, address := range addresses {
+		if errs[i] != nil {
+			t.Fatalf("server%d: %v", i, errs[i])
+		}
+		if previous, ok := seen[address]; ok {
+			t.Errorf("server%d and server%d both got %s", previous, i, address)
+		}
+		seen[address] = i
+
+		if node := stub.node(address); node.Status != 1 || node.Comments != fmt.Sprintf("server%d", i) {
+			t.Errorf("server%d got %s, but IPAM has status %d and comment '%s'", i, address, node.Status, node.Comments)
+		}
+	}
+
+	// Someone got 10.0.0.1 first and lost it, then moved on to another address
+	if _, ok := seen["10.0.0.1"]; ok {
+		t.Errorf("10.0.0.1 was handed out although someone else took it")
+	}
+	if bookings := stub.bookings("10.0.0.1"); len(bookings) != 1 {
+		t.Errorf("expected one lost booking of 10.0.0.1, got %v", bookings)
+	}
+}
+
+func TestClaimIpEntityLost(t *testing.T) {
+	withSettleDelay(t, time.Millisecond)
+	stub, client := newIpamStub(t)
+	stub.steal["10.0.0.7"] = "someone else"
+
+	locks := &keyedMutex{locks: map[string]*sync.Mutex{}}
+	claimed, err := claimIpEntity(context.Background(), client, locks, IPEntity{SubnetId: 1, IPAddress: "10.0.0.7"}, 1, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claimed {
+		t.Errorf("claimed 10.0.0.7 although someone else overwrote it")
+	}
+
+	// A taken address is not written to at all
+	claimed, err = claimIpEntity(context.Background(), client, locks, IPEntity{SubnetId: 1, IPAddress: "10.0.0.7"}, 1, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bookings := stub.bookings("10.0.0.7"); claimed || len(bookings) != 1 {
+		t.Errorf("expected 10.0.0.7 to be left alone once taken, bookings %v", bookings)
+	}
+}
+
+func TestGetFreeIpEntityRandom(t *testing.T) {
+	stub, client := newIpamStub(t)
+	subnet := &Subnet{SubnetId: 1, Address: "10.0.0.0", CIDR: 24}
+	allocation := ipAllocation{Strategy: allocateRandom}
+
+	// Picks reach the top of the subnet, not just the lowest free addresses
+	highest := 0
+	for i := 0; i < 64; i++ {
+		ipEntity, err := getFreeIpEntity(context.Background(), client, subnet, allocation, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ipEntity.Status != 2 {
+			t.Fatalf("picked %s with status %d", ipEntity.IPAddress, ipEntity.Status)
+		}
+		if ipEntity.IpNodeId > highest {
+			highest = ipEntity.IpNodeId
+		}
+	}
+	if highest < 128 {
+		t.Errorf("64 random picks never went above host %d", highest)
+	}
+
+	// Only the bottom host is left, picks past it wrap around to it
+	stub.mu.Lock()
+	for _, node := range stub.nodes[2:] {
+		node.Status = 1
+	}
+	stub.mu.Unlock()
+
+	for i := 0; i < 16; i++ {
+		ipEntity, err := getFreeIpEntity(context.Background(), client, subnet, allocation, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ipEntity.IPAddress != "10.0.0.1" {
+			t.Fatalf("expected the last free address 10.0.0.1, got %s", ipEntity.IPAddress)
+		}
+	}
+}
+
+func TestAllocateIpEntitySparse(t *testing.T) {
+	withSettleDelay(t, time.Millisecond)
+	stub, client := newIpamStub(t)
+
+	// IPAM only knows a few addresses of the IPv6 subnet, one of them free
+	stub.mu.Lock()
+	for i, status := range []int{1, 2, 1} {
+		stub.nodes = append(stub.nodes, &IPEntity{
+			IpNodeId:  len(stub.nodes),
+			SubnetId:  2,
+			IPAddress: "2001:db8::" + strconv.Itoa(i+1),
+			Status:    status,
+			Uri:       "IPAM.IPNode/" + strconv.Itoa(len(stub.nodes)),
+		})
+	}
+	stub.mu.Unlock()
+
+	locks := &keyedMutex{locks: map[string]*sync.Mutex{}}
+	subnet := &Subnet{SubnetId: 2, Address: "2001:db8::", CIDR: 64}
+	allocation := ipAllocation{
+		Strategy:   allocateFirst,
+		Exclusions: ipExclusions{Ranges: []ipRange{{Start: "2001:db8::5", End: "2001:db8::6"}}},
+	}
+
+	// The free known address first, then past the used one to an unknown
+	// address, then past the excluded range to the next unknown one
+	for i, expected := range []string{"2001:db8::2", "2001:db8::4", "2001:db8::7"} {
+		comment := fmt.Sprintf("server%d", i)
+		ipEntity, err := allocateIpEntity(context.Background(), client, locks, subnet, allocation, 1, comment)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ipEntity.IPAddress != expected {
+			t.Errorf("allocation %d got %s, expected %s", i, ipEntity.IPAddress, expected)
+		}
+		if node := stub.node(expected); node.SubnetId != 2 || node.Status != 1 || node.Comments != comment {
+			t.Errorf("%s has subnet %d, status %d and comment '%s' in IPAM", expected, node.SubnetId, node.Status, node.Comments)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package orion
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+)
+
+const credentialsCommandTimeout = 1 * time.Minute
+
+// Output expected from credentials_command
+type commandCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Resolve the SWIS credentials. password, password_file and credentials_command are
+// mutually exclusive, an explicit username always wins over the one from the command,
+// and the environment is only consulted when none of them are set.
+func resolveCredentials(ctx context.Context, config orionConfig) (string, string, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	sources := 0
+	for _, set := range []bool{!config.Password.IsNull(), !config.PasswordFile.IsNull(), !config.CredentialsCommand.IsNull()} {
+		if set {
+			sources++
+		}
+	}
+
+	if sources > 1 {
+		diags.AddAttributeError(
+			path.Root("password"),
+			"Conflicting password sources given",
+			"Only one of password, password_file and credentials_command may be set",
+		)
+		return "", "", diags
+	}
+
+	username := stringFromConfigOrEnv(config.Username, "SOLARWINDS_ORION_USERNAME", "")
+	password := stringFromConfigOrEnv(config.Password, "SOLARWINDS_ORION_PASSWORD", "")
+
+	if !config.PasswordFile.IsNull() {
+		passwordFile := config.PasswordFile.ValueString()
+		content, err := os.ReadFile(passwordFile)
+		if err != nil {
+			diags.AddAttributeError(
+				path.Root("password_file"),
+				"Unable to read password file",
+				fmt.Sprintf("Failed to read '%s': %s", passwordFile, err),
+			)
+			return "", "", diags
+		}
+		password = strings.TrimRight(string(content), "\r\n")
+	}
+
+	if !config.CredentialsCommand.IsNull() {
+		var command []string
+		diags.Append(config.CredentialsCommand.ElementsAs(ctx, &command, false)...)
+		if diags.HasError() {
+			return "", "", diags
+		}
+
+		credentials, err := runCredentialsCommand(ctx, command)
+		if err != nil {
+			diags.AddAttributeError(
+				path.Root("credentials_command"),
+				"Unable to get credentials from command",
+				err.Error(),
+			)
+			return "", "", diags
+		}
+
+		if config.Username.IsNull() && credentials.Username != "" {
+			username = credentials.Username
+		}
+		password = credentials.Password
+	}
+
+	return username, password, diags
+}
+
+// Run the credentials helper and parse the JSON it prints on stdout
+func runCredentialsCommand(ctx context.Context, command []string) (*commandCredentials, error) {
+	if len(command) == 0 || command[0] == "" {
+		return nil, fmt.Errorf("credentials_command must name a program to run")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, credentialsCommandTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("'%s' failed: %v: %s", command[0], err, msg)
+		}
+		return nil, fmt.Errorf("'%s' failed: %v", command[0], err)
+	}
+
+	var credentials commandCredentials
+	if err := json.Unmarshal(stdout.Bytes(), &credentials); err != nil {
+		return nil, fmt.Errorf("'%s' did not print a JSON object with username and password: %v", command[0], err)
+	}
+
+	if credentials.Password == "" {
+		return nil, fmt.Errorf("'%s' did not return a password", command[0])
+	}
+
+	return &credentials, nil
+}
@@ -0,0 +1,90 @@
+package orion
+
+import (
+	"context"
+	"strconv"
+	"sync"
+)
+
+// Data handed by the provider to its resources and data sources
+type orionData struct {
+	client *swisClient
+
+	// Provider settings resources may need
+	version    string
+	servers    []string
+	readOnly   bool
+	exclusions ipExclusions
+
+	// What Configure detected on the Orion server
+	info *serverInfo
+
+	// Shared across all resources of this provider instance
+	subnets *subnetCache
+	locks   *keyedMutex
+}
+
+func newOrionData(client *swisClient, version string, servers []string, info *serverInfo) *orionData {
+	return &orionData{
+		client:  client,
+		version: version,
+		servers: servers,
+		info:    info,
+		subnets: &subnetCache{entries: map[string]*Subnet{}},
+		locks:   &keyedMutex{locks: map[string]*sync.Mutex{}},
+	}
+}
+
+// Subnets looked up by selector. IPAM subnets rarely change during a run, and
+// many resources usually point at the same few subnets.
+type subnetCache struct {
+	mu      sync.Mutex
+	entries map[string]*Subnet
+}
+
+func (c *subnetCache) get(ctx context.Context, client *swisClient, selector subnetSelector) (*Subnet, error) {
+	key := selector.String()
+
+	c.mu.Lock()
+	subnet, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok {
+		return subnet, nil
+	}
+
+	subnet, err := getSubnetBySelector(ctx, client, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = subnet
+	c.mu.Unlock()
+
+	return subnet, nil
+}
+
+// One mutex per key, for operations that must not interleave such as
+// allocating addresses from the same subnet
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	lock, ok := k.locks[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		k.locks[key] = lock
+	}
+	k.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Lock key serializing allocations in one IPAM subnet, whatever address it was looked up by
+func subnetLockKey(subnetId int) string {
+	return "subnet/" + strconv.Itoa(subnetId)
+}
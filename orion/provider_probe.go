@@ -0,0 +1,133 @@
+package orion
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// Orion modules the provider knows how to detect
+const (
+	moduleIPAM = "IPAM"
+	moduleNCM  = "NCM"
+	moduleSAM  = "SAM"
+	moduleUDT  = "UDT"
+)
+
+// Entity that only exists in SWIS when the module is installed
+var moduleEntities = map[string]string{
+	moduleIPAM: "IPAM.Subnet",
+	moduleNCM:  "NCM.Nodes",
+	moduleSAM:  "Orion.APM.Application",
+	moduleUDT:  "Orion.UDT.Port",
+}
+
+// What the provider learned about the Orion server during Configure
+type serverInfo struct {
+	PlatformVersion string
+	Modules         map[string]bool
+}
+
+// Return an error naming the missing module when it is not installed
+func (s *serverInfo) requireModule(module string) error {
+	if s == nil || s.Modules[module] {
+		return nil
+	}
+	return fmt.Errorf("the %s module is not installed on this Orion server (platform version %s)", module, s.PlatformVersion)
+}
+
+// Run a cheap metadata query to check connectivity and permissions, and
+// detect the platform version and the installed modules
+func probeServer(ctx context.Context, client *swisClient) (*serverInfo, error) {
+	var entities []struct {
+		FullName string `json:"fullname"`
+	}
+
+	names := make([]string, 0, len(moduleEntities))
+	for _, entity := range moduleEntities {
+		names = append(names, "'"+entity+"'")
+	}
+	sort.Strings(names)
+
+	res, err := client.Query(ctx, "SELECT FullName FROM Metadata.Entity WHERE FullName IN ("+strings.Join(names, ",")+")", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(res, &entities); err != nil {
+		return nil, err
+	}
+
+	info := &serverInfo{
+		PlatformVersion: "unknown",
+		Modules:         map[string]bool{},
+	}
+	for module, entity := range moduleEntities {
+		for _, found := range entities {
+			if strings.EqualFold(found.FullName, entity) {
+				info.Modules[module] = true
+			}
+		}
+	}
+
+	// The version is informational, older platforms may not expose it
+	var modules []struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	res, err = client.Query(ctx, "SELECT Name, Version FROM Orion.InstalledModule WHERE Name='Orion Platform'", nil)
+	if err == nil && json.Unmarshal(res, &modules) == nil && len(modules) != 0 {
+		info.PlatformVersion = modules[0].Version
+	} else {
+		log.Printf("[DEBUG] Could not detect Orion platform version: %v", err)
+	}
+
+	return info, nil
+}
+
+// Turn a failed probe into a summary and detail fit for a diagnostic
+func describeProbeError(server string, err error) (string, string) {
+	var swisErr *swisError
+	if errors.As(err, &swisErr) {
+		switch swisErr.StatusCode {
+		case http.StatusUnauthorized:
+			return "SolarWinds Orion authentication failed",
+				fmt.Sprintf("%s rejected the credentials. Check username, password and auth_method.", server)
+		case http.StatusForbidden:
+			return "SolarWinds Orion permission denied",
+				fmt.Sprintf("The account is not allowed to query SWIS on %s.", server)
+		case http.StatusNotFound:
+			return "SolarWinds Orion API not found",
+				fmt.Sprintf("%s did not serve SWIS at the configured path. Check port, scheme and base_path.", server)
+		}
+		return "SolarWinds Orion API error", err.Error()
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "Unable to resolve SolarWinds Orion server",
+			fmt.Sprintf("Looking up %s failed: %s", dnsErr.Name, dnsErr.Err)
+	}
+
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	var invalid x509.CertificateInvalidError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &hostname) || errors.As(err, &invalid) {
+		return "SolarWinds Orion certificate verification failed",
+			fmt.Sprintf("%s. Set ca_cert_file or ca_cert_pem to trust the issuing CA, or tls_server_name when connecting by another name.", err)
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, context.DeadlineExceeded) {
+		return "Unable to connect to SolarWinds Orion",
+			fmt.Sprintf("Could not reach %s: %s. Check server, port and any proxy settings.", server, err)
+	}
+
+	return "Unable to connect to SolarWinds Orion", err.Error()
+}
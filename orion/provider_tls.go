@@ -0,0 +1,157 @@
+package orion
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Build the TLS configuration used to talk to SWIS from the provider configuration
+func buildTLSConfig(config orionConfig, insecure bool) (*tls.Config, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+
+	for _, attr := range []struct {
+		name  string
+		value types.String
+	}{
+		{"ca_cert_file", config.CACertFile},
+		{"ca_cert_pem", config.CACertPEM},
+		{"client_cert", config.ClientCert},
+		{"client_key", config.ClientKey},
+		{"tls_server_name", config.TLSServerName},
+		{"min_tls_version", config.MinTLSVersion},
+	} {
+		if attr.value.IsUnknown() {
+			diags.AddAttributeError(
+				path.Root(attr.name),
+				"Unknown value for "+attr.name+" given",
+				"Failed to create SolarWinds Orion client with given "+attr.name,
+			)
+		}
+	}
+
+	if diags.HasError() {
+		return nil, diags
+	}
+
+	if !config.CACertFile.IsNull() || !config.CACertPEM.IsNull() {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !config.CACertFile.IsNull() {
+			caFile := config.CACertFile.ValueString()
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				diags.AddAttributeError(
+					path.Root("ca_cert_file"),
+					"Unable to read CA certificate file",
+					fmt.Sprintf("Failed to read '%s': %s", caFile, err),
+				)
+			} else if !pool.AppendCertsFromPEM(pem) {
+				diags.AddAttributeError(
+					path.Root("ca_cert_file"),
+					"Invalid CA certificate file",
+					fmt.Sprintf("No PEM encoded certificates found in '%s'", caFile),
+				)
+			}
+		}
+
+		if !config.CACertPEM.IsNull() && !pool.AppendCertsFromPEM([]byte(config.CACertPEM.ValueString())) {
+			diags.AddAttributeError(
+				path.Root("ca_cert_pem"),
+				"Invalid CA certificate",
+				"No PEM encoded certificates found in ca_cert_pem",
+			)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.ClientCert.IsNull() != config.ClientKey.IsNull() {
+		diags.AddAttributeError(
+			path.Root("client_cert"),
+			"Incomplete client certificate",
+			"Both client_cert and client_key must be set to use a client certificate",
+		)
+	} else if !config.ClientCert.IsNull() {
+		certPEM, certDiags := readPEMAttribute(path.Root("client_cert"), config.ClientCert.ValueString())
+		keyPEM, keyDiags := readPEMAttribute(path.Root("client_key"), config.ClientKey.ValueString())
+		diags.Append(certDiags...)
+		diags.Append(keyDiags...)
+
+		if !certDiags.HasError() && !keyDiags.HasError() {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				diags.AddAttributeError(
+					path.Root("client_cert"),
+					"Invalid client certificate",
+					fmt.Sprintf("Failed to load client certificate and key: %s", err),
+				)
+			} else {
+				tlsConfig.Certificates = []tls.Certificate{cert}
+			}
+		}
+	}
+
+	if !config.TLSServerName.IsNull() {
+		tlsConfig.ServerName = config.TLSServerName.ValueString()
+	}
+
+	if !config.MinTLSVersion.IsNull() {
+		version, ok := tlsVersions[config.MinTLSVersion.ValueString()]
+		if !ok {
+			diags.AddAttributeError(
+				path.Root("min_tls_version"),
+				"Invalid minimum TLS version",
+				fmt.Sprintf("min_tls_version must be one of 1.0, 1.1, 1.2 or 1.3, got '%s'", config.MinTLSVersion.ValueString()),
+			)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if diags.HasError() {
+		return nil, diags
+	}
+
+	return tlsConfig, diags
+}
+
+// PEM attributes accept either the PEM content itself or a path to a file holding it
+func readPEMAttribute(attr path.Path, value string) ([]byte, diag.Diagnostics) {
+	var diags diag.Diagnostics
+
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), diags
+	}
+
+	content, err := os.ReadFile(value)
+	if err != nil {
+		diags.AddAttributeError(
+			attr,
+			"Unable to read PEM file",
+			fmt.Sprintf("Value is neither PEM content nor a readable file: %s", err),
+		)
+		return nil, diags
+	}
+
+	return content, diags
+}
@@ -3,18 +3,31 @@ package orion
 import (
 	"context"
 	"fmt"
+	"log"
+	"net"
+	"strings"
 	"time"
-    "strings"
 
+	"github.com/hashicorp/terraform-plugin-framework-timeouts/resource/timeouts"
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/resourcevalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64default"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/planmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringdefault"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringplanmodifier"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
 	"github.com/hashicorp/terraform-plugin-framework/types"
-	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
-	"github.com/mrxinu/gosolar"
 )
 
 type Subnet struct {
 	SubnetId      int    `json:"subnetid"`
+	ParentId      int    `json:"parentid"`
+	FriendlyName  string `json:"friendlyname"`
 	Uri           string `json:"uri"`
 	CIDR          int    `json:"cidr"`
 	GroupTypeText string `json:"grouptypetext"`
@@ -39,19 +52,74 @@ type resourceIPReservationModel struct {
 	ID          types.String `tfsdk:"id"`
 	LastUpdated types.String `tfsdk:"last_updated"`
 
-	VLANAddress    string `tfsdk:"vlan_address"`
-	VLANName       string `tfsdk:"vlan_name"`
-	VLANMask       int    `tfsdk:"vlan_mask"`
-	Comment        string `tfsdk:"comment"`
-	StatusCode     int    `tfsdk:"status_code"`
-	IPAddress      string `tfsdk:"ip_address"`
-	AvoidDHCPScope bool   `tfsdk:"avoid_dhcp_scope"`
+	SubnetID    types.Int64  `tfsdk:"subnet_id"`
+	SubnetCIDR  types.String `tfsdk:"subnet_cidr"`
+	SubnetGroup types.String `tfsdk:"subnet_group"`
+
+	VLANAddress   types.String `tfsdk:"vlan_address"`
+	VLANName      types.String `tfsdk:"vlan_name"`
+	VLANMask      types.Int64  `tfsdk:"vlan_mask"`
+	Comment       types.String `tfsdk:"comment"`
+	StatusCode    types.Int64  `tfsdk:"status_code"`
+	IPAddress     types.String `tfsdk:"ip_address"`
+	OnDHCPScope   types.String `tfsdk:"on_dhcp_scope"`
+	ReleaseStatus types.String `tfsdk:"release_status"`
+
+	AllocationStrategy types.String `tfsdk:"allocation_strategy"`
+	HostNumber         types.Int64  `tfsdk:"host_number"`
+
+	ExcludeFirst  types.Int64 `tfsdk:"exclude_first"`
+	ExcludeLast   types.Int64 `tfsdk:"exclude_last"`
+	ExcludeRanges types.List  `tfsdk:"exclude_ranges"`
+
+	Timeouts timeouts.Value `tfsdk:"timeouts"`
+}
+
+const (
+	defaultIPCreateTimeout = 5 * time.Minute
+	defaultIPReadTimeout   = 2 * time.Minute
+	defaultIPUpdateTimeout = 5 * time.Minute
+	defaultIPDeleteTimeout = 5 * time.Minute
+)
+
+// IPAM statuses an address may be left in when the resource is destroyed
+var releaseStatusCodes = map[string]int{
+	"Available": 2,
+	"Reserved":  4,
+	"Transient": 8,
 }
 
+// What happens when the subnet is a DHCP scope
+const (
+	dhcpScopeError   = "error"
+	dhcpScopeSkip    = "skip"
+	dhcpScopeOutside = "allocate_outside_scope"
+
+	// ID of reservations skipped because their subnet is a DHCP scope
+	dhcpSkippedID = "dhcp"
+)
+
+// How a free address is picked when ip_address is not set
+const (
+	allocateFirst   = "first"
+	allocateLast    = "last"
+	allocateRandom  = "random"
+	allocateHostnum = "hostnum"
+)
+
 type resourceIP struct {
-	client *gosolar.Client
+	client *swisClient
+	data   *orionData
 }
 
+// Ensure the optional resource interfaces are implemented
+var (
+	_ resource.ResourceWithModifyPlan       = &resourceIP{}
+	_ resource.ResourceWithImportState      = &resourceIP{}
+	_ resource.ResourceWithValidateConfig   = &resourceIP{}
+	_ resource.ResourceWithConfigValidators = &resourceIP{}
+)
+
 func (r *resourceIP) Metadata(_ context.Context, req resource.MetadataRequest, resp *resource.MetadataResponse) {
 	resp.TypeName = req.ProviderTypeName + "_ip"
 }
@@ -61,48 +129,413 @@ func (r *resourceIP) Configure(_ context.Context, req resource.ConfigureRequest,
 		return
 	}
 
-	r.client = req.ProviderData.(*gosolar.Client)
+	data, ok := req.ProviderData.(*orionData)
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Unexpected Resource Configure Type",
+			fmt.Sprintf("Expected *orionData, got: %T. Please report this issue to the provider developers.", req.ProviderData),
+		)
+		return
+	}
+
+	r.data = data
+	r.client = data.client
 }
 
-func (r *resourceIP) Schema(_ context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
+func (r *resourceIP) Schema(ctx context.Context, req resource.SchemaRequest, resp *resource.SchemaResponse) {
 	resp.Schema = schema.Schema{
+		Description: "Reserves an IP address in SolarWinds IPAM.",
 		Attributes: map[string]schema.Attribute{
+			"id": schema.StringAttribute{
+				Computed:    true,
+				Description: "Reserved IP address.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
+			},
+			"last_updated": schema.StringAttribute{
+				Computed:    true,
+				Description: "Time the reservation was last changed by Terraform.",
+			},
+			"subnet_id": schema.Int64Attribute{
+				Optional:    true,
+				Computed:    true,
+				Description: "IPAM ID of the subnet to reserve the address in. Exactly one of subnet_id, subnet_cidr, subnet_group and vlan_address must be set.",
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.RequiresReplaceIfConfigured(),
+					int64planmodifier.UseStateForUnknown(),
+				},
+			},
+			"subnet_cidr": schema.StringAttribute{
+				Optional:    true,
+				Description: "Network address and prefix length of the subnet to reserve the address in, such as 10.1.2.0/24. Changing it only replaces the reservation when it selects another subnet.",
+				Validators: []validator.String{
+					subnetCIDRValidator{},
+				},
+			},
+			"subnet_group": schema.StringAttribute{
+				Optional:    true,
+				Description: "Path of IPAM group, supernet and subnet names leading to the subnet to reserve the address in, such as Datacenter/Servers/Web. Leading groups may be left out. Changing it only replaces the reservation when it selects another subnet.",
+			},
 			"vlan_address": schema.StringAttribute{
-				Required: true,
+				Optional:    true,
+				Computed:    true,
+				Description: "Network address of the subnet to reserve the address in. Fails when IPAM has several subnets with this address.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplaceIfConfigured(),
+					stringplanmodifier.UseStateForUnknown(),
+				},
+				Validators: []validator.String{
+					ipAddressValidator{},
+				},
 			},
 			"vlan_name": schema.StringAttribute{
-				Optional: true,
-				Computed: true,
+				Optional:    true,
+				Computed:    true,
+				Description: "VLAN name of the subnet. When set, it must match the name in IPAM.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.UseStateForUnknown(),
+				},
 			},
-			"vlan_mask": schema.NumberAttribute{
-				Optional: true,
+			"vlan_mask": schema.Int64Attribute{
+				Optional:    true,
+				Computed:    true,
+				Description: "Prefix length of the subnet as recorded in IPAM. When set, planning fails unless IPAM agrees.",
+				Validators: []validator.Int64{
+					int64validator.Between(1, 128),
+				},
 			},
 			"comment": schema.StringAttribute{
-				Required: true,
+				Required:    true,
+				Description: "Comment stored on the address, usually the name of the server it is reserved for.",
 			},
-			"status_code": schema.NumberAttribute{
-				Optional: true,
+			"status_code": schema.Int64Attribute{
+				Optional:    true,
+				Computed:    true,
+				Default:     int64default.StaticInt64(1),
+				Description: "IPAM status of the reserved address: 1 used, 4 reserved or 8 transient. Defaults to 1. Available (2) is not a reservation, use release_status for what destroy leaves behind.",
+				Validators: []validator.Int64{
+					int64validator.OneOf(1, 4, 8),
+				},
 			},
 			"ip_address": schema.StringAttribute{
-				Optional: true,
-				Computed: true,
+				Optional:    true,
+				Computed:    true,
+				Description: "Address to reserve. When not set, the first free address in the subnet is reserved.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplaceIfConfigured(),
+					stringplanmodifier.UseStateForUnknown(),
+				},
+				Validators: []validator.String{
+					ipAddressValidator{},
+				},
+			},
+			"allocation_strategy": schema.StringAttribute{
+				Optional:    true,
+				Computed:    true,
+				Default:     stringdefault.StaticString(allocateFirst),
+				Description: "How a free address is picked when ip_address is not set: first, last, random or hostnum. Defaults to first.",
+				PlanModifiers: []planmodifier.String{
+					stringplanmodifier.RequiresReplaceIf(
+						hostnumToggled,
+						"Switching away from hostnum releases the fixed host and picks a new address.",
+						"Switching away from hostnum releases the fixed host and picks a new address.",
+					),
+				},
+				Validators: []validator.String{
+					stringvalidator.OneOf(allocateFirst, allocateLast, allocateRandom, allocateHostnum),
+				},
+			},
+			"host_number": schema.Int64Attribute{
+				Optional:    true,
+				Description: "Host number within the subnet to reserve with the hostnum strategy, like cidrhost. Negative numbers count back from the end of the subnet.",
+				PlanModifiers: []planmodifier.Int64{
+					int64planmodifier.RequiresReplaceIf(
+						hostNumberMoved,
+						"Changing the host number moves the reservation to another address.",
+						"Changing the host number moves the reservation to another address.",
+					),
+				},
+			},
+			"exclude_first": schema.Int64Attribute{
+				Optional:    true,
+				Description: "Number of hosts at the start of the subnet that are never allocated. Defaults to the provider's exclude_first.",
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
 			},
-			"avoid_dhcp_scope": schema.BoolAttribute{
-				Optional: true,
+			"exclude_last": schema.Int64Attribute{
+				Optional:    true,
+				Description: "Number of hosts at the end of the subnet that are never allocated. Defaults to the provider's exclude_last.",
+				Validators: []validator.Int64{
+					int64validator.AtLeast(0),
+				},
 			},
+			"exclude_ranges": schema.ListNestedAttribute{
+				Optional:    true,
+				Description: "Ranges that are never allocated from, given by addresses or host numbers within the subnet. Replaces the provider's exclude_ranges.",
+				NestedObject: schema.NestedAttributeObject{
+					Attributes: map[string]schema.Attribute{
+						"start": schema.StringAttribute{
+							Required:    true,
+							Description: "First excluded address or host number.",
+							Validators: []validator.String{
+								ipAddressOrNumberValidator{},
+							},
+						},
+						"end": schema.StringAttribute{
+							Required:    true,
+							Description: "Last excluded address or host number.",
+							Validators: []validator.String{
+								ipAddressOrNumberValidator{},
+							},
+						},
+					},
+				},
+			},
+			"on_dhcp_scope": schema.StringAttribute{
+				Optional:    true,
+				Computed:    true,
+				Default:     stringdefault.StaticString(dhcpScopeError),
+				Description: "What to do when the subnet is a DHCP scope: error fails, skip creates the resource without reserving an address, allocate_outside_scope only reserves addresses outside the DHCP pool ranges. Defaults to error.",
+				Validators: []validator.String{
+					stringvalidator.OneOf(dhcpScopeError, dhcpScopeSkip, dhcpScopeOutside),
+				},
+			},
+			"release_status": schema.StringAttribute{
+				Optional:    true,
+				Computed:    true,
+				Default:     stringdefault.StaticString("Available"),
+				Description: "Status the address is left in when the resource is destroyed: Available, Reserved or Transient. Defaults to Available.",
+				Validators: []validator.String{
+					stringvalidator.OneOf("Available", "Reserved", "Transient"),
+				},
+			},
+		},
+		Blocks: map[string]schema.Block{
+			"timeouts": timeouts.Block(ctx, timeouts.Opts{
+				Create: true,
+				Read:   true,
+				Update: true,
+				Delete: true,
+			}),
 		},
 	}
 }
 
-func (r *resourceIP) Resources(_ context.Context) []func() resource.Resource {
-	return []func() resource.Resource{
-		NewIPResource,
+func (r *resourceIP) ConfigValidators(_ context.Context) []resource.ConfigValidator {
+	return []resource.ConfigValidator{
+		resourcevalidator.ExactlyOneOf(
+			path.MatchRoot("subnet_id"),
+			path.MatchRoot("subnet_cidr"),
+			path.MatchRoot("subnet_group"),
+			path.MatchRoot("vlan_address"),
+		),
+	}
+}
+
+func (r *resourceIP) ValidateConfig(ctx context.Context, req resource.ValidateConfigRequest, resp *resource.ValidateConfigResponse) {
+	var config resourceIPReservationModel
+
+	diags := req.Config.Get(ctx, &config)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
+
+	if !config.AllocationStrategy.IsUnknown() && !config.HostNumber.IsUnknown() {
+		hostnum := config.AllocationStrategy.ValueString() == allocateHostnum
+		if hostnum && config.HostNumber.IsNull() {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("host_number"),
+				"Missing host number",
+				"host_number must be set when allocation_strategy is hostnum.",
+			)
+		}
+
+		if !hostnum && !config.HostNumber.IsNull() {
+			resp.Diagnostics.AddAttributeError(
+				path.Root("host_number"),
+				"Unexpected host number",
+				"host_number is only used when allocation_strategy is hostnum.",
+			)
+		}
+	}
+
+	if !config.IPAddress.IsNull() && !config.AllocationStrategy.IsNull() {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("allocation_strategy"),
+			"Conflicting address selection",
+			"allocation_strategy only applies when ip_address is not set.",
+		)
+	}
+
+	subnetAddress := config.VLANAddress.ValueString()
+	if ip, _, err := net.ParseCIDR(config.SubnetCIDR.ValueString()); err == nil {
+		subnetAddress = ip.String()
+	}
+	if vlan := net.ParseIP(subnetAddress); vlan != nil && vlan.To4() != nil && config.VLANMask.ValueInt64() > 32 {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("vlan_mask"),
+			"Invalid IPv4 prefix length",
+			fmt.Sprintf("vlan_mask must be at most 32 for an IPv4 subnet, got %d.", config.VLANMask.ValueInt64()),
+		)
+	}
+}
+
+// Warn while planning when the provider cannot apply any change to this resource
+func (r *resourceIP) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	if r.data == nil {
+		return
+	}
+
+	if r.data.readOnly {
+		resp.Diagnostics.AddWarning(
+			"Provider is read only",
+			"This provider is configured with read_only = true, applying changes to this IP reservation will be refused.",
+		)
+	}
+
+	// Nothing left to check when destroying
+	if req.Plan.Raw.IsNull() {
+		return
+	}
+
+	if err := r.data.info.requireModule(moduleIPAM); err != nil {
+		resp.Diagnostics.AddError(
+			"Error planning IP reservation",
+			err.Error(),
+		)
+		return
+	}
+
+	var plan, config resourceIPReservationModel
+
+	diags := req.Plan.Get(ctx, &plan)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
+
+	diags = req.Config.Get(ctx, &config)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
+
+	// A skipped reservation has to be made for real once DHCP scopes are no longer skipped
+	if !req.State.Raw.IsNull() {
+		var skippedID types.String
+		resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("id"), &skippedID)...)
+		if skippedID.ValueString() == dhcpSkippedID && !plan.OnDHCPScope.IsUnknown() && plan.OnDHCPScope.ValueString() != dhcpScopeSkip {
+			resp.RequiresReplace = append(resp.RequiresReplace, path.Root("on_dhcp_scope"))
+		}
+	}
+
+	// subnet_cidr and subnet_group only force a new reservation when they select
+	// another subnet, so setting them on an imported reservation keeps its address
+	if !req.State.Raw.IsNull() {
+		var stateSubnetID types.Int64
+		resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("subnet_id"), &stateSubnetID)...)
+
+		var selectorPath path.Path
+		var selector subnetSelector
+		switch {
+		case config.SubnetCIDR.IsUnknown():
+			resp.RequiresReplace = append(resp.RequiresReplace, path.Root("subnet_cidr"))
+		case config.SubnetGroup.IsUnknown():
+			resp.RequiresReplace = append(resp.RequiresReplace, path.Root("subnet_group"))
+		case !config.SubnetCIDR.IsNull():
+			selectorPath, selector = path.Root("subnet_cidr"), subnetSelector{CIDR: config.SubnetCIDR.ValueString()}
+		case !config.SubnetGroup.IsNull():
+			selectorPath, selector = path.Root("subnet_group"), subnetSelector{Path: config.SubnetGroup.ValueString()}
+		}
+
+		if selector != (subnetSelector{}) {
+			selected, selectErr := r.data.subnets.get(ctx, r.client, selector)
+			if selectErr != nil {
+				resp.Diagnostics.AddAttributeError(
+					selectorPath,
+					"Error planning IP reservation",
+					selectErr.Error(),
+				)
+				return
+			}
+			if int64(selected.SubnetId) != stateSubnetID.ValueInt64() {
+				resp.RequiresReplace = append(resp.RequiresReplace, selectorPath)
+			}
+		}
+	}
+
+	// A changed selector may point at another subnet, while the planned
+	// subnet_id still holds the one in state
+	selectorChanged := false
+	if !req.State.Raw.IsNull() {
+		var state resourceIPReservationModel
+		diags = req.State.Get(ctx, &state)
+		resp.Diagnostics.Append(diags...)
+		if diags.HasError() {
+			return
+		}
+		selectorChanged = (!config.SubnetID.IsNull() && !config.SubnetID.Equal(state.SubnetID)) ||
+			(!config.SubnetCIDR.IsNull() && !config.SubnetCIDR.Equal(state.SubnetCIDR)) ||
+			(!config.SubnetGroup.IsNull() && !config.SubnetGroup.Equal(state.SubnetGroup)) ||
+			(!config.VLANAddress.IsNull() && !sameAddress(config.VLANAddress.ValueString(), state.VLANAddress.ValueString()))
+	}
+
+	// The subnet can only be looked up once the attributes selecting it are known
+	selectFrom := plan
+	if plan.SubnetID.IsUnknown() || selectorChanged {
+		if config.SubnetID.IsUnknown() || config.SubnetCIDR.IsUnknown() || config.SubnetGroup.IsUnknown() || config.VLANAddress.IsUnknown() {
+			return
+		}
+		selectFrom = config
+	}
+
+	subnet, getSubnetErr := r.data.subnets.get(ctx, r.client, subnetSelectorFrom(selectFrom))
+	if getSubnetErr != nil {
+		resp.Diagnostics.AddError(
+			"Error planning IP reservation",
+			getSubnetErr.Error(),
+		)
+		return
+	}
+
+	// Plan what Create records for the newly selected subnet
+	if selectorChanged {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("subnet_id"), subnet.SubnetId)...)
+		if config.VLANAddress.IsNull() {
+			resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("vlan_address"), subnet.Address)...)
+		}
+		if config.VLANName.IsNull() {
+			resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("vlan_name"), subnet.VlanName)...)
+		}
+	}
+
+	// IPAM is the source of truth for the prefix length, a configured vlan_mask only asserts it
+	if maskErr := checkVlanMask(config.VLANMask, subnet); maskErr != nil {
+		resp.Diagnostics.AddAttributeError(
+			path.Root("vlan_mask"),
+			"Subnet mask mismatch",
+			maskErr.Error(),
+		)
+		return
 	}
+
+	resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("vlan_mask"), subnet.CIDR)...)
 }
 
 func (r *resourceIP) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
 	client := r.client
 
+	if err := r.data.info.requireModule(moduleIPAM); err != nil {
+		resp.Diagnostics.AddError(
+			"Error creating IP reservation",
+			err.Error(),
+		)
+		return
+	}
+
 	var plan resourceIPReservationModel
 
 	diags := req.Plan.Get(ctx, &plan)
@@ -111,24 +544,50 @@ func (r *resourceIP) Create(ctx context.Context, req resource.CreateRequest, res
 		return
 	}
 
+	createTimeout, diags := plan.Timeouts.Create(ctx, defaultIPCreateTimeout)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, createTimeout)
+	defer cancel()
+
 	//declare vars
-	vlan_address := plan.VLANAddress
-	comment := plan.Comment
-	avoid_dhcp_scope := plan.AvoidDHCPScope
-	ip_address := plan.IPAddress
-	status_code := plan.StatusCode
-	vlan_name := plan.VLANName
-	vlan_mask := plan.VLANMask
-
-	computedVlanName, VlanNameErr := getVlanName(client, vlan_address)
-	if VlanNameErr != nil {
+	vlan_address := plan.VLANAddress.ValueString()
+	comment := plan.Comment.ValueString()
+	on_dhcp_scope := plan.OnDHCPScope.ValueString()
+	ip_address := plan.IPAddress.ValueString()
+	status_code := int(plan.StatusCode.ValueInt64())
+	vlan_name := plan.VLANName.ValueString()
+
+	subnet, getSubnetErr := r.data.subnets.get(ctx, client, subnetSelectorFrom(plan))
+	if getSubnetErr != nil {
+		resp.Diagnostics.AddError(
+			"Error creating IP reservation",
+			getSubnetErr.Error(),
+		)
+		return
+	}
+
+	computedVlanName := subnet.VlanName
+	subnetId := subnet.SubnetId
+
+	if maskErr := checkVlanMask(plan.VLANMask, subnet); maskErr != nil {
 		resp.Diagnostics.AddError(
 			"Error creating IP reservation",
-			VlanNameErr.Error(),
+			maskErr.Error(),
 		)
 		return
 	}
 
+	plan.VLANMask = types.Int64Value(int64(subnet.CIDR))
+	plan.SubnetID = types.Int64Value(int64(subnetId))
+	if vlan_address == "" {
+		vlan_address = subnet.Address
+		plan.VLANAddress = types.StringValue(subnet.Address)
+	}
+
 	if vlan_name != "" && vlan_name != computedVlanName {
 		resp.Diagnostics.AddError(
 			"Error creating IP reservation",
@@ -138,68 +597,110 @@ func (r *resourceIP) Create(ctx context.Context, req resource.CreateRequest, res
 	}
 
 	if vlan_name == "" {
-		plan.VLANName = computedVlanName
+		plan.VLANName = types.StringValue(computedVlanName)
 	}
 
-	subnetId, getSubnetErr := getSubnetId(client, vlan_address)
-	if getSubnetErr != nil {
-		// return getSubnetErr
+	subnetDHCP, getSubnetDhcpErr := checkIfSubnetDHCP(ctx, client, subnetId)
+	if getSubnetDhcpErr != nil {
 		resp.Diagnostics.AddError(
 			"Error creating IP reservation",
-			getSubnetErr.Error(),
+			getSubnetDhcpErr.Error(),
 		)
 		return
 	}
 
-	if avoid_dhcp_scope {
-		subnetDHCP, getSubnetDhcpErr := checkIfSubnetDHCP(client, vlan_address)
-		if getSubnetDhcpErr != nil {
-			// return getSubnetDhcpErr
-			resp.Diagnostics.AddError(
-				"Error creating IP reservation",
-				getSubnetDhcpErr.Error(),
-			)
-			return
-		}
-
-		if subnetDHCP && ip_address == "" {
-			resp.Diagnostics.AddError(
-				"Error creating IP reservation",
-				"No IP provided and avoid DHCP subnets is true, so cannot do anthing.",
-			)
+	var dhcpPools []ipRange
+	if subnetDHCP {
+		switch on_dhcp_scope {
+		case dhcpScopeSkip:
+			// Skipping reserves nothing, so a static address would only be held in state
+			if ip_address != "" {
+				resp.Diagnostics.AddAttributeError(
+					path.Root("ip_address"),
+					"Error creating IP reservation",
+					fmt.Sprintf("Subnet %s/%d is a DHCP scope and on_dhcp_scope is skip, so IP address '%s' cannot be reserved. Use allocate_outside_scope to reserve it outside the DHCP pools.", subnet.Address, subnet.CIDR, ip_address),
+				)
+				return
+			}
+
+			log.Printf("[INFO] Subnet %s/%d is a DHCP scope, not reserving an address", subnet.Address, subnet.CIDR)
+
+			plan.ID = types.StringValue(dhcpSkippedID)
+			if plan.IPAddress.IsUnknown() {
+				plan.IPAddress = types.StringNull()
+			}
+			plan.LastUpdated = types.StringValue(time.Now().Format(time.RFC850))
+
+			diags = resp.State.Set(ctx, plan)
+			resp.Diagnostics.Append(diags...)
 			return
-		}
 
-		if subnetDHCP && ip_address != "" {
+		case dhcpScopeOutside:
+			pools, getPoolsErr := getDhcpPoolRanges(ctx, client, subnetId)
+			if getPoolsErr != nil {
+				resp.Diagnostics.AddError(
+					"Error creating IP reservation",
+					getPoolsErr.Error(),
+				)
+				return
+			}
+
+			if len(pools) == 0 {
+				resp.Diagnostics.AddError(
+					"Error creating IP reservation",
+					fmt.Sprintf("Subnet %s/%d is a DHCP scope, but IPAM knows none of its pool ranges to allocate outside of.", subnet.Address, subnet.CIDR),
+				)
+				return
+			}
+			dhcpPools = pools
+
+		default:
 			resp.Diagnostics.AddError(
 				"Error creating IP reservation",
-				"You are trying to get static IP from subnet with DHCP Scope!",
+				fmt.Sprintf("Subnet %s/%d is a DHCP scope. Set on_dhcp_scope to skip or allocate_outside_scope to use it anyway.", subnet.Address, subnet.CIDR),
 			)
 			return
 		}
 	}
 
 	if ip_address == "" {
-		ipEntity, getIpError := getFreeIpEntity(client, subnetId)
-		if getIpError != nil {
-			resp.Diagnostics.AddError(
-				"Error creating IP reservation",
-				getIpError.Error(),
-			)
+		exclusions, diags := resolveExclusions(ctx, plan, r.data.exclusions)
+		resp.Diagnostics.Append(diags...)
+		if diags.HasError() {
 			return
 		}
 
-		updateErr := updateIpEntity(client, *ipEntity, status_code, comment)
-		if updateErr != nil {
+		// Addresses in DHCP pools are never allocated, not even by host number
+		exclusions.Ranges = append(append([]ipRange{}, exclusions.Ranges...), dhcpPools...)
+
+		allocation := ipAllocation{
+			Strategy:   plan.AllocationStrategy.ValueString(),
+			HostNumber: plan.HostNumber.ValueInt64(),
+			Exclusions: exclusions,
+		}
+
+		if allocation.Strategy == allocateHostnum && len(dhcpPools) != 0 {
+			hostAddress, hostErr := cidrHost(subnet.Address, subnet.CIDR, allocation.HostNumber)
+			if hostErr == nil && addressInRanges(hostAddress, dhcpPools) {
+				resp.Diagnostics.AddError(
+					"Error creating IP reservation",
+					fmt.Sprintf("Host number %d (%s) is in a DHCP pool of subnet %s/%d.", allocation.HostNumber, hostAddress, subnet.Address, subnet.CIDR),
+				)
+				return
+			}
+		}
+
+		ipEntity, allocateErr := allocateIpEntity(ctx, client, r.data.locks, subnet, allocation, status_code, comment)
+		if allocateErr != nil {
 			resp.Diagnostics.AddError(
 				"Error creating IP reservation",
-				updateErr.Error(),
+				allocateErr.Error(),
 			)
 			return
 		}
 
-		plan.IPAddress = ipEntity.IPAddress
-		plan.ID = basetypes.NewStringValue(ipEntity.IPAddress)
+		plan.IPAddress = types.StringValue(ipEntity.IPAddress)
+		plan.ID = types.StringValue(ipEntity.IPAddress)
 		plan.LastUpdated = types.StringValue(time.Now().Format(time.RFC850))
 
 		diags = resp.State.Set(ctx, plan)
@@ -218,7 +719,7 @@ func (r *resourceIP) Create(ctx context.Context, req resource.CreateRequest, res
 			return
 		}
 
-		ipSubnetError := validateAddresInSubnet(vlan_address, vlan_mask, ip_address)
+		ipSubnetError := validateAddresInSubnet(subnet.Address, subnet.CIDR, ip_address)
 		if ipSubnetError != nil {
 			resp.Diagnostics.AddError(
 				"Error creating IP reservation",
@@ -227,7 +728,15 @@ func (r *resourceIP) Create(ctx context.Context, req resource.CreateRequest, res
 			return
 		}
 
-		ipEntity, getIpError := getIpEntityByAddress(client, ip_address)
+		if addressInRanges(ip_address, dhcpPools) {
+			resp.Diagnostics.AddError(
+				"Error creating IP reservation",
+				fmt.Sprintf("IP address '%s' is in a DHCP pool of subnet %s/%d.", ip_address, subnet.Address, subnet.CIDR),
+			)
+			return
+		}
+
+		ipEntity, getIpError := getClaimableIpEntity(ctx, client, subnet, ip_address)
 		if getIpError != nil {
 			resp.Diagnostics.AddError(
 				"Error creating IP reservation",
@@ -244,17 +753,25 @@ func (r *resourceIP) Create(ctx context.Context, req resource.CreateRequest, res
 			return
 		}
 
-		updateErr := updateIpEntity(client, *ipEntity, status_code, comment)
-		if updateErr != nil {
+		claimed, claimErr := claimIpEntity(ctx, client, r.data.locks, *ipEntity, status_code, comment)
+		if claimErr != nil {
 			resp.Diagnostics.AddError(
 				"Error creating IP reservation",
-				updateErr.Error(),
+				claimErr.Error(),
+			)
+			return
+		}
+
+		if !claimed {
+			resp.Diagnostics.AddError(
+				"Error creating IP reservation",
+				fmt.Sprintf("IP address '%s' was claimed by someone else while it was being booked.", ip_address),
 			)
 			return
 		}
 
-		plan.IPAddress = ipEntity.IPAddress
-		plan.ID = basetypes.NewStringValue(ipEntity.IPAddress)
+		// ip_address keeps the spelling from the configuration, IPv6 may be written many ways
+		plan.ID = types.StringValue(ipEntity.IPAddress)
 		plan.LastUpdated = types.StringValue(time.Now().Format(time.RFC850))
 
 		diags = resp.State.Set(ctx, plan)
@@ -266,85 +783,523 @@ func (r *resourceIP) Create(ctx context.Context, req resource.CreateRequest, res
 }
 
 func (r *resourceIP) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
-    client := r.client
-
-    var state resourceIPReservationModel
-    diags := resp.State.Get(ctx, &state)
-    resp.Diagnostics.Append(diags...)
-    if diags.HasError() {
-        return
-    }
-
-	id := state.ID.String()
-	vlan_address := state.VLANAddress
-	comment := state.Comment
-	avoid_dhcp_scope := state.AvoidDHCPScope
-	ip_address := state.IPAddress
-	vlan_name := state.VLANName
-
-	//Validate if it's dhcp error to handle
-	if id == "dhcp" && ip_address == "dhcp" {
-		return 
-	}
-
-	computedVlanName, VlanNameErr := getVlanName(client, vlan_address)
-	if VlanNameErr != nil {
-        resp.Diagnostics.AddError(
-            "Error reading IP reservation",
-            VlanNameErr.Error(),
-        )
-        return
+	client := r.client
+
+	if err := r.data.info.requireModule(moduleIPAM); err != nil {
+		resp.Diagnostics.AddError(
+			"Error reading IP reservation",
+			err.Error(),
+		)
+		return
 	}
-	if vlan_name != "" && vlan_name != computedVlanName {
-        resp.Diagnostics.AddError(
-            "Error reading IP reservation",
-            fmt.Sprintf("There is mismatch in vlan name that you've provided ('%s') and computed value which is %s", vlan_name, computedVlanName),
-        )
-        return
+
+	var state resourceIPReservationModel
+	diags := resp.State.Get(ctx, &state)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
+
+	readTimeout, diags := state.Timeouts.Read(ctx, defaultIPReadTimeout)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
 	}
 
-	ipEntity,_ := getIpEntityByAddress(client, ip_address)
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
 
-	//Validate if provided ip address is assigned to this machine
-	if !strings.Contains(ipEntity.Comments, comment) && ipEntity.Status != 2 {
-        resp.Diagnostics.AddError(
-            "Error reading IP reservation",
-            fmt.Sprintf("IP address '%s' is not assigned to '%s'", ip_address, comment),
-        )
-        return
+	id := state.ID.ValueString()
+	comment := state.Comment.ValueString()
+	on_dhcp_scope := state.OnDHCPScope.ValueString()
+	ip_address := state.IPAddress.ValueString()
+	vlan_name := state.VLANName.ValueString()
+
+	subnet, getSubnetErr := r.data.subnets.get(ctx, client, subnetSelectorFrom(state))
+	if getSubnetErr != nil {
+		resp.Diagnostics.AddError(
+			"Error reading IP reservation",
+			getSubnetErr.Error(),
+		)
+		return
+	}
+
+	// Fill in the subnet for reservations created before it was tracked
+	state.SubnetID = types.Int64Value(int64(subnet.SubnetId))
+	state.VLANMask = types.Int64Value(int64(subnet.CIDR))
+	if state.VLANAddress.IsNull() {
+		state.VLANAddress = types.StringValue(subnet.Address)
+	}
+
+	computedVlanName := subnet.VlanName
+	if vlan_name != "" && vlan_name != computedVlanName {
+		resp.Diagnostics.AddError(
+			"Error reading IP reservation",
+			fmt.Sprintf("There is mismatch in vlan name that you've provided ('%s') and computed value which is %s", vlan_name, computedVlanName),
+		)
+		return
 	}
 
-	dhcpScope,dhcpErr := checkIfSubnetDHCP(client, vlan_address)
+	dhcpScope, dhcpErr := checkIfSubnetDHCP(ctx, client, subnet.SubnetId)
 	if dhcpErr != nil {
-        resp.Diagnostics.AddError(
-            "Error reading IP reservation",
-            dhcpErr.Error(),
-        )
-        return
+		resp.Diagnostics.AddError(
+			"Error reading IP reservation",
+			dhcpErr.Error(),
+		)
+		return
 	}
 
-	//Validate if subnet is DHCP AND avoid_dhcp_scope is true
-	if avoid_dhcp_scope && dhcpScope {
-        resp.Diagnostics.AddError(
-            "Error reading IP reservation",
-            "avoid_dhcp_flag set to true, but subnet HAS dhcp scope",
-        ) 
-        return
+	//Skipped reservations stay skipped only while the subnet is a DHCP scope that should be skipped
+	if id == dhcpSkippedID {
+		if !dhcpScope || on_dhcp_scope != dhcpScopeSkip {
+			log.Printf("[INFO] Subnet %s/%d no longer needs to be skipped, planning a real reservation", subnet.Address, subnet.CIDR)
+			resp.State.RemoveResource(ctx)
+			return
+		}
+
+		diags = resp.State.Set(ctx, &state)
+		resp.Diagnostics.Append(diags...)
+		return
 	}
 
-    state.IPAddress = ipEntity.IPAddress
+	ipEntity, getIpError := getIpEntityInSubnet(ctx, client, subnet.SubnetId, ip_address)
+	if getIpError != nil {
+		resp.Diagnostics.AddError(
+			"Error reading IP reservation",
+			getIpError.Error(),
+		)
+		return
+	}
 
-    diags = resp.State.Set(ctx, &state)
-    resp.Diagnostics.Append(diags...)
-    if diags.HasError() {
-        return
-    }
+	//An address someone else holds now is no longer ours, so the reservation is gone
+	if ipEntity.Comments != comment && ipEntity.Status != 2 {
+		resp.Diagnostics.AddWarning(
+			"IP reservation taken over",
+			fmt.Sprintf("IP address '%s' is no longer assigned to '%s' (comment is '%s'), removing it from state so Terraform plans to create it again.", ip_address, comment, ipEntity.Comments),
+		)
+		resp.State.RemoveResource(ctx)
+		return
+	}
+
+	//The subnet may have become a DHCP scope after the address was reserved
+	if dhcpScope {
+		dhcpWarning := ""
+		switch on_dhcp_scope {
+		case dhcpScopeError:
+			dhcpWarning = fmt.Sprintf("Subnet %s/%d has become a DHCP scope since IP address '%s' was reserved.", subnet.Address, subnet.CIDR, ip_address)
+		case dhcpScopeOutside:
+			pools, getPoolsErr := getDhcpPoolRanges(ctx, client, subnet.SubnetId)
+			if getPoolsErr != nil {
+				resp.Diagnostics.AddError(
+					"Error reading IP reservation",
+					getPoolsErr.Error(),
+				)
+				return
+			}
+			if addressInRanges(ip_address, pools) {
+				dhcpWarning = fmt.Sprintf("IP address '%s' is now inside a DHCP pool of subnet %s/%d.", ip_address, subnet.Address, subnet.CIDR)
+			}
+		}
+
+		if dhcpWarning != "" {
+			resp.Diagnostics.AddWarning(
+				"IP reservation overlaps DHCP",
+				dhcpWarning,
+			)
+		}
+	}
+
+	if !sameAddress(ip_address, ipEntity.IPAddress) {
+		state.IPAddress = types.StringValue(ipEntity.IPAddress)
+	}
+
+	// Changes made in IPAM show up as drift, so the next apply sets them back
+	state.Comment = types.StringValue(ipEntity.Comments)
+	state.StatusCode = types.Int64Value(int64(ipEntity.Status))
+
+	diags = resp.State.Set(ctx, &state)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
 }
 
-func (r *resourceIP) Update(_ context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+func (r *resourceIP) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	client := r.client
+
+	if err := r.data.info.requireModule(moduleIPAM); err != nil {
+		resp.Diagnostics.AddError(
+			"Error updating IP reservation",
+			err.Error(),
+		)
+		return
+	}
+
+	var plan, state resourceIPReservationModel
+
+	diags := req.Plan.Get(ctx, &plan)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
+
+	diags = req.State.Get(ctx, &state)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
+
+	updateTimeout, diags := plan.Timeouts.Update(ctx, defaultIPUpdateTimeout)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, updateTimeout)
+	defer cancel()
+
+	vlan_name := plan.VLANName.ValueString()
+	ip_address := state.IPAddress.ValueString()
+
+	subnet, getSubnetErr := r.data.subnets.get(ctx, client, subnetSelectorFrom(state))
+	if getSubnetErr != nil {
+		resp.Diagnostics.AddError(
+			"Error updating IP reservation",
+			getSubnetErr.Error(),
+		)
+		return
+	}
+
+	computedVlanName := subnet.VlanName
+
+	if vlan_name != "" && vlan_name != computedVlanName {
+		resp.Diagnostics.AddError(
+			"Error updating IP reservation",
+			fmt.Sprintf("There is mismatch in vlan name that you've provided ('%s') and computed value which is %s", vlan_name, computedVlanName),
+		)
+		return
+	}
+
+	if maskErr := checkVlanMask(plan.VLANMask, subnet); maskErr != nil {
+		resp.Diagnostics.AddError(
+			"Error updating IP reservation",
+			maskErr.Error(),
+		)
+		return
+	}
+
+	plan.VLANName = types.StringValue(computedVlanName)
+	plan.VLANMask = types.Int64Value(int64(subnet.CIDR))
+	plan.IPAddress = state.IPAddress
+	plan.ID = state.ID
+
+	//Subnets with DHCP scope have no address of their own to update
+	if state.ID.ValueString() == dhcpSkippedID {
+		diags = resp.State.Set(ctx, plan)
+		resp.Diagnostics.Append(diags...)
+		return
+	}
+
+	ipEntity, getIpError := getIpEntityInSubnet(ctx, client, subnet.SubnetId, ip_address)
+	if getIpError != nil {
+		resp.Diagnostics.AddError(
+			"Error updating IP reservation",
+			getIpError.Error(),
+		)
+		return
+	}
+
+	status_code := int(plan.StatusCode.ValueInt64())
+	comment := plan.Comment.ValueString()
+
+	// An address released in IPAM since it was reserved is free for anyone, so it has to be claimed again
+	if state.StatusCode.ValueInt64() == 2 {
+		claimed, claimErr := claimIpEntity(ctx, client, r.data.locks, *ipEntity, status_code, comment)
+		if claimErr != nil {
+			resp.Diagnostics.AddError(
+				"Error updating IP reservation",
+				claimErr.Error(),
+			)
+			return
+		}
+
+		if !claimed {
+			resp.Diagnostics.AddError(
+				"Error updating IP reservation",
+				fmt.Sprintf("IP address '%s' was released in IPAM and claimed by someone else before it could be reserved again.", ip_address),
+			)
+			return
+		}
+	} else {
+		updateErr := updateIpEntity(ctx, client, *ipEntity, status_code, comment)
+		if updateErr != nil {
+			resp.Diagnostics.AddError(
+				"Error updating IP reservation",
+				updateErr.Error(),
+			)
+			return
+		}
+	}
+
+	plan.LastUpdated = types.StringValue(time.Now().Format(time.RFC850))
+
+	diags = resp.State.Set(ctx, plan)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
 }
 
-func (r *resourceIP) Delete(_ context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+func (r *resourceIP) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	client := r.client
+
+	if err := r.data.info.requireModule(moduleIPAM); err != nil {
+		resp.Diagnostics.AddError(
+			"Error releasing IP reservation",
+			err.Error(),
+		)
+		return
+	}
+
+	var state resourceIPReservationModel
+
+	diags := req.State.Get(ctx, &state)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
+
+	deleteTimeout, diags := state.Timeouts.Delete(ctx, defaultIPDeleteTimeout)
+	resp.Diagnostics.Append(diags...)
+	if diags.HasError() {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, deleteTimeout)
+	defer cancel()
+
+	ip_address := state.IPAddress.ValueString()
+	comment := state.Comment.ValueString()
+
+	//Subnets with DHCP scope have no address to release
+	if state.ID.ValueString() == dhcpSkippedID {
+		return
+	}
+
+	release_status, ok := releaseStatusCodes[state.ReleaseStatus.ValueString()]
+	if !ok {
+		resp.Diagnostics.AddError(
+			"Error releasing IP reservation",
+			fmt.Sprintf("Unknown release_status '%s', expected Available, Reserved or Transient", state.ReleaseStatus.ValueString()),
+		)
+		return
+	}
+
+	subnet, getSubnetErr := r.data.subnets.get(ctx, client, subnetSelectorFrom(state))
+	if getSubnetErr != nil {
+		resp.Diagnostics.AddError(
+			"Error releasing IP reservation",
+			getSubnetErr.Error(),
+		)
+		return
+	}
+
+	ipEntity, getIpError := getIpEntityInSubnet(ctx, client, subnet.SubnetId, ip_address)
+	if getIpError != nil {
+		resp.Diagnostics.AddError(
+			"Error releasing IP reservation",
+			getIpError.Error(),
+		)
+		return
+	}
+
+	if ipEntity.Status == 2 {
+		return
+	}
+
+	//Never free an address that has been handed to someone else in the meantime
+	if ipEntity.Comments != comment {
+		resp.Diagnostics.AddWarning(
+			"IP reservation not released",
+			fmt.Sprintf("IP address '%s' is no longer assigned to '%s' (comment is '%s'), leaving it untouched in IPAM", ip_address, comment, ipEntity.Comments),
+		)
+		return
+	}
+
+	updateErr := updateIpEntity(ctx, client, *ipEntity, release_status, "")
+	if updateErr != nil {
+		resp.Diagnostics.AddError(
+			"Error releasing IP reservation",
+			updateErr.Error(),
+		)
+		return
+	}
+}
+
+// Import an existing reservation by its address, or by <subnet>/<cidr>:<address>
+// when the address exists in several overlapping subnets
+func (r *resourceIP) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
+	client := r.client
+
+	if err := r.data.info.requireModule(moduleIPAM); err != nil {
+		resp.Diagnostics.AddError(
+			"Error importing IP reservation",
+			err.Error(),
+		)
+		return
+	}
+
+	subnet_cidr, ip_address := splitImportID(req.ID)
+
+	ipError := validateAddresses(ip_address)
+	if ipError != nil {
+		resp.Diagnostics.AddError(
+			"Error importing IP reservation",
+			ipError.Error(),
+		)
+		return
+	}
+
+	var ipEntity *IPEntity
+	var subnet *Subnet
+
+	if subnet_cidr != "" {
+		subnetAddress, subnetNet, err := net.ParseCIDR(subnet_cidr)
+		if err != nil || !subnetAddress.Equal(subnetNet.IP) {
+			resp.Diagnostics.AddError(
+				"Error importing IP reservation",
+				fmt.Sprintf("'%s' is not a valid subnet, expected an ID such as 10.1.2.0/24:10.1.2.3", subnet_cidr),
+			)
+			return
+		}
+		cidr, _ := subnetNet.Mask.Size()
+
+		var getSubnetErr error
+		subnet, getSubnetErr = getSubnetByCIDR(ctx, client, subnetNet.IP.String(), cidr)
+		if getSubnetErr != nil {
+			resp.Diagnostics.AddError(
+				"Error importing IP reservation",
+				getSubnetErr.Error(),
+			)
+			return
+		}
+
+		var getIpError error
+		ipEntity, getIpError = getIpEntityInSubnet(ctx, client, subnet.SubnetId, ip_address)
+		if getIpError != nil {
+			resp.Diagnostics.AddError(
+				"Error importing IP reservation",
+				getIpError.Error(),
+			)
+			return
+		}
+	} else {
+		ipEntities, getIpError := getIpEntitiesByAddress(ctx, client, ip_address)
+		if getIpError != nil {
+			resp.Diagnostics.AddError(
+				"Error importing IP reservation",
+				getIpError.Error(),
+			)
+			return
+		}
+
+		if len(ipEntities) > 1 {
+			resp.Diagnostics.AddError(
+				"Error importing IP reservation",
+				fmt.Sprintf("IP address '%s' exists in %d subnets, import it as <subnet>/<cidr>:%s instead", ip_address, len(ipEntities), ip_address),
+			)
+			return
+		}
+		ipEntity = &ipEntities[0]
+
+		var getSubnetErr error
+		subnet, getSubnetErr = getSubnetById(ctx, client, ipEntity.SubnetId)
+		if getSubnetErr != nil {
+			resp.Diagnostics.AddError(
+				"Error importing IP reservation",
+				getSubnetErr.Error(),
+			)
+			return
+		}
+	}
+
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("id"), ipEntity.IPAddress)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("ip_address"), ipEntity.IPAddress)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("subnet_id"), subnet.SubnetId)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("vlan_address"), subnet.Address)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("vlan_name"), subnet.VlanName)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("vlan_mask"), subnet.CIDR)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("comment"), ipEntity.Comments)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("status_code"), ipEntity.Status)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("on_dhcp_scope"), dhcpScopeError)...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("release_status"), "Available")...)
+	resp.Diagnostics.Append(resp.State.SetAttribute(ctx, path.Root("allocation_strategy"), allocateFirst)...)
+}
+
+// Whether allocation_strategy switches away from hostnum. Switching to it is
+// left to host_number, the other strategies only matter when the address is
+// first picked.
+func hostnumToggled(_ context.Context, req planmodifier.StringRequest, resp *stringplanmodifier.RequiresReplaceIfFuncResponse) {
+	resp.RequiresReplace = req.StateValue.ValueString() == allocateHostnum && req.PlanValue.ValueString() != allocateHostnum
+}
+
+// Whether host_number points at another address than the reserved one. Imported
+// reservations have no host number yet, they only move when it is a different host.
+func hostNumberMoved(ctx context.Context, req planmodifier.Int64Request, resp *int64planmodifier.RequiresReplaceIfFuncResponse) {
+	if req.PlanValue.IsNull() {
+		return
+	}
+	if req.PlanValue.IsUnknown() {
+		resp.RequiresReplace = true
+		return
+	}
+
+	var state resourceIPReservationModel
+	resp.Diagnostics.Append(req.State.Get(ctx, &state)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	address, err := cidrHost(state.VLANAddress.ValueString(), int(state.VLANMask.ValueInt64()), req.PlanValue.ValueInt64())
+	resp.RequiresReplace = err != nil || !sameAddress(address, state.IPAddress.ValueString())
+}
+
+// Check a vlan_mask against the prefix length IPAM records for the subnet, unset masks always agree
+func checkVlanMask(mask types.Int64, subnet *Subnet) error {
+	if mask.IsNull() || mask.IsUnknown() || mask.ValueInt64() == int64(subnet.CIDR) {
+		return nil
+	}
+	return fmt.Errorf("vlan_mask is %d, but IPAM records subnet %s/%d", mask.ValueInt64(), subnet.Address, subnet.CIDR)
+}
+
+// Selector for the subnet of a reservation. Once the subnet ID is known it is
+// the most precise, the other selectors only matter until then.
+func subnetSelectorFrom(model resourceIPReservationModel) subnetSelector {
+	switch {
+	case !model.SubnetID.IsNull() && !model.SubnetID.IsUnknown():
+		return subnetSelector{ID: model.SubnetID.ValueInt64()}
+	case !model.SubnetCIDR.IsNull():
+		return subnetSelector{CIDR: model.SubnetCIDR.ValueString()}
+	case !model.SubnetGroup.IsNull():
+		return subnetSelector{Path: model.SubnetGroup.ValueString()}
+	}
+	return subnetSelector{Address: model.VLANAddress.ValueString()}
+}
+
+// Split an import ID into the optional subnet CIDR and the address. The subnet
+// part ends at the first colon after the prefix length, so IPv6 works too.
+func splitImportID(id string) (string, string) {
+	slash := strings.Index(id, "/")
+	if slash < 0 {
+		return "", id
+	}
+
+	colon := strings.Index(id[slash:], ":")
+	if colon < 0 {
+		return "", id
+	}
+
+	return id[:slash+colon], id[slash+colon+1:]
 }
 
 //func resourceIp() *schema.Resource {
@@ -0,0 +1,91 @@
+package orion
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
+)
+
+// Validates that a string attribute holds an IPv4 or IPv6 address
+type ipAddressValidator struct{}
+
+func (v ipAddressValidator) Description(_ context.Context) string {
+	return "value must be a valid IP address"
+}
+
+func (v ipAddressValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v ipAddressValidator) ValidateString(_ context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+
+	if net.ParseIP(req.ConfigValue.ValueString()) == nil {
+		resp.Diagnostics.AddAttributeError(
+			req.Path,
+			"Invalid IP address",
+			fmt.Sprintf("'%s' is not a valid IP address", req.ConfigValue.ValueString()),
+		)
+	}
+}
+
+// Validates that a string attribute holds an IP address or a non-negative host number
+type ipAddressOrNumberValidator struct{}
+
+func (v ipAddressOrNumberValidator) Description(_ context.Context) string {
+	return "value must be a valid IP address or host number"
+}
+
+func (v ipAddressOrNumberValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v ipAddressOrNumberValidator) ValidateString(_ context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+
+	value := req.ConfigValue.ValueString()
+	if number, ok := new(big.Int).SetString(value, 10); ok && number.Sign() >= 0 {
+		return
+	}
+
+	if net.ParseIP(value) == nil {
+		resp.Diagnostics.AddAttributeError(
+			req.Path,
+			"Invalid IP address or host number",
+			fmt.Sprintf("'%s' is neither a valid IP address nor a host number", value),
+		)
+	}
+}
+
+// Validates that a string attribute holds a network address and prefix length
+type subnetCIDRValidator struct{}
+
+func (v subnetCIDRValidator) Description(_ context.Context) string {
+	return "value must be a network address and prefix length such as 10.1.2.0/24"
+}
+
+func (v subnetCIDRValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v subnetCIDRValidator) ValidateString(_ context.Context, req validator.StringRequest, resp *validator.StringResponse) {
+	if req.ConfigValue.IsNull() || req.ConfigValue.IsUnknown() {
+		return
+	}
+
+	address, network, err := net.ParseCIDR(req.ConfigValue.ValueString())
+	if err != nil || !address.Equal(network.IP) {
+		resp.Diagnostics.AddAttributeError(
+			req.Path,
+			"Invalid subnet",
+			fmt.Sprintf("'%s' is not a network address and prefix length such as 10.1.2.0/24", req.ConfigValue.ValueString()),
+		)
+	}
+}